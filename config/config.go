@@ -0,0 +1,284 @@
+// Package config provides a declarative way to build Dialers out of named
+// dialers, chains and load balancing groups, from JSON.
+//
+// A configuration looks like:
+//
+//	{
+//	  "dialers": {
+//	    "ws": {"url": "ws://example.com/path"},
+//	    "hk": {"url": "ss://...", "forward": "ws"},
+//	    "jp": {"url": "ratelimit://?r=1M -> socks5://example.org"}
+//	  },
+//	  "groups": {
+//	    "auto": {"strategy": "failover", "dialers": ["hk", "jp"]}
+//	  },
+//	  "main": "auto"
+//	}
+//
+// The url of a dialer can be a single URL, or a chain of URLs accepted by
+// proxy.FromChain. A dialer makes underlying connections with the dialer
+// or group named by its forward, or directly if forward is empty or
+// "direct". A group picks a loadbalance.Strategy by name, which must be
+// registered, typically by importing one of the strategy packages.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/b97tsk/proxy"
+	"github.com/b97tsk/proxy/loadbalance"
+)
+
+// Direct is the reserved name of proxy.Direct.
+const Direct = "direct"
+
+// A Config defines named dialers and groups.
+type Config struct {
+	Dialers map[string]DialerConfig `json:"dialers,omitempty"`
+	Groups  map[string]GroupConfig  `json:"groups,omitempty"`
+
+	// Main names the dialer or group that Dialer returns by default.
+	Main string `json:"main,omitempty"`
+}
+
+// A DialerConfig defines a dialer by URL.
+type DialerConfig struct {
+	URL     string `json:"url"`
+	Forward string `json:"forward,omitempty"`
+}
+
+// A GroupConfig defines a load balancing group.
+type GroupConfig struct {
+	Strategy string   `json:"strategy"`
+	Dialers  []string `json:"dialers"`
+}
+
+// Parse parses data as a JSON configuration, and validates it.
+func Parse(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("proxy/config: %w", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// Load reads the named file and parses it with Parse.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/config: %w", err)
+	}
+
+	return Parse(data)
+}
+
+// Validate checks that every name is defined exactly once, every strategy
+// is registered, and that there are no reference cycles.
+func (c *Config) Validate() error {
+	for name, d := range c.Dialers {
+		if name == "" || name == Direct {
+			return fmt.Errorf("proxy/config: invalid dialer name: %q", name)
+		}
+
+		if _, ok := c.Groups[name]; ok {
+			return fmt.Errorf("proxy/config: name defined as both dialer and group: %q", name)
+		}
+
+		if d.URL == "" {
+			return fmt.Errorf("proxy/config: dialer %q: missing url", name)
+		}
+
+		if d.Forward != "" && !c.defined(d.Forward) {
+			return fmt.Errorf("proxy/config: dialer %q: unknown forward: %q", name, d.Forward)
+		}
+	}
+
+	for name, g := range c.Groups {
+		if name == "" || name == Direct {
+			return fmt.Errorf("proxy/config: invalid group name: %q", name)
+		}
+
+		if loadbalance.Get(g.Strategy) == nil {
+			return fmt.Errorf("proxy/config: group %q: unknown strategy: %q", name, g.Strategy)
+		}
+
+		if len(g.Dialers) == 0 {
+			return fmt.Errorf("proxy/config: group %q: no dialers", name)
+		}
+
+		for _, member := range g.Dialers {
+			if !c.defined(member) {
+				return fmt.Errorf("proxy/config: group %q: unknown dialer: %q", name, member)
+			}
+		}
+	}
+
+	if c.Main != "" && !c.defined(c.Main) {
+		return fmt.Errorf("proxy/config: unknown main: %q", c.Main)
+	}
+
+	return c.checkCycles()
+}
+
+func (c *Config) defined(name string) bool {
+	if name == Direct {
+		return true
+	}
+
+	if _, ok := c.Dialers[name]; ok {
+		return true
+	}
+
+	_, ok := c.Groups[name]
+
+	return ok
+}
+
+// refs returns names that name refers to.
+func (c *Config) refs(name string) []string {
+	if d, ok := c.Dialers[name]; ok {
+		if d.Forward != "" {
+			return []string{d.Forward}
+		}
+
+		return nil
+	}
+
+	return c.Groups[name].Dialers
+}
+
+func (c *Config) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+
+	var path []string
+
+	var visit func(name string) error
+
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, s := range path {
+				if s == name {
+					cycle := append(path[i:len(path):len(path)], name)
+					return fmt.Errorf("proxy/config: reference cycle: %v", strings.Join(cycle, " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+
+		for _, ref := range c.refs(name) {
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+
+		return nil
+	}
+
+	for name := range c.Dialers {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	for name := range c.Groups {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Dialer builds the dialer or group of the given name, along with all the
+// dialers and groups it refers to. If name is empty, Main is used.
+func (c *Config) Dialer(name string) (proxy.Dialer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = c.Main
+	}
+
+	if !c.defined(name) {
+		return nil, fmt.Errorf("proxy/config: unknown name: %q", name)
+	}
+
+	b := &builder{c, make(map[string]proxy.Dialer)}
+
+	return b.build(name)
+}
+
+// builder builds each name at most once, so that a dialer or group that
+// is referred to multiple times is shared.
+type builder struct {
+	c     *Config
+	built map[string]proxy.Dialer
+}
+
+func (b *builder) build(name string) (proxy.Dialer, error) {
+	if name == "" || name == Direct {
+		return proxy.Direct, nil
+	}
+
+	if d, ok := b.built[name]; ok {
+		return d, nil
+	}
+
+	var d proxy.Dialer
+
+	if dc, ok := b.c.Dialers[name]; ok {
+		forward, err := b.build(dc.Forward)
+		if err != nil {
+			return nil, err
+		}
+
+		d, err = proxy.FromChain(dc.URL, forward)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/config: dialer %q: %w", name, err)
+		}
+	} else {
+		gc := b.c.Groups[name]
+
+		dialers := make([]proxy.Dialer, len(gc.Dialers))
+
+		for i, member := range gc.Dialers {
+			var err error
+			if dialers[i], err = b.build(member); err != nil {
+				return nil, err
+			}
+		}
+
+		d = loadbalance.Get(gc.Strategy)(dialers)
+	}
+
+	b.built[name] = d
+
+	return d, nil
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	_ "github.com/b97tsk/proxy/loadbalance/strategy/failover"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string // substring of the error, or empty if none
+	}{
+		{
+			"valid",
+			`{
+				"dialers": {
+					"a": {"url": "socks5://127.0.0.1:1080"},
+					"b": {"url": "http://127.0.0.1:8080", "forward": "a"},
+					"c": {"url": "socks5://127.0.0.1:1081", "forward": "direct"}
+				},
+				"groups": {
+					"auto": {"strategy": "failover", "dialers": ["b", "c", "direct"]}
+				},
+				"main": "auto"
+			}`,
+			"",
+		},
+		{
+			"unknown field",
+			`{"dialers": {"a": {"uri": "socks5://127.0.0.1:1080"}}}`,
+			"unknown field",
+		},
+		{
+			"invalid dialer name",
+			`{"dialers": {"direct": {"url": "socks5://127.0.0.1:1080"}}}`,
+			"invalid dialer name",
+		},
+		{
+			"invalid group name",
+			`{"groups": {"": {"strategy": "failover", "dialers": ["direct"]}}}`,
+			"invalid group name",
+		},
+		{
+			"both dialer and group",
+			`{
+				"dialers": {"a": {"url": "socks5://127.0.0.1:1080"}},
+				"groups": {"a": {"strategy": "failover", "dialers": ["direct"]}}
+			}`,
+			"both dialer and group",
+		},
+		{
+			"missing url",
+			`{"dialers": {"a": {}}}`,
+			"missing url",
+		},
+		{
+			"unknown forward",
+			`{"dialers": {"a": {"url": "socks5://127.0.0.1:1080", "forward": "b"}}}`,
+			`unknown forward: "b"`,
+		},
+		{
+			"unknown strategy",
+			`{"groups": {"g": {"strategy": "nosuch", "dialers": ["direct"]}}}`,
+			`unknown strategy: "nosuch"`,
+		},
+		{
+			"empty group",
+			`{"groups": {"g": {"strategy": "failover", "dialers": []}}}`,
+			"no dialers",
+		},
+		{
+			"unknown group member",
+			`{"groups": {"g": {"strategy": "failover", "dialers": ["direct", "b"]}}}`,
+			`unknown dialer: "b"`,
+		},
+		{
+			"unknown main",
+			`{"dialers": {"a": {"url": "socks5://127.0.0.1:1080"}}, "main": "b"}`,
+			`unknown main: "b"`,
+		},
+		{
+			"self cycle",
+			`{"dialers": {"a": {"url": "socks5://127.0.0.1:1080", "forward": "a"}}}`,
+			"reference cycle: a -> a",
+		},
+		{
+			"cycle through group",
+			`{
+				"dialers": {"a": {"url": "socks5://127.0.0.1:1080", "forward": "g"}},
+				"groups": {"g": {"strategy": "failover", "dialers": ["a"]}}
+			}`,
+			"reference cycle",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data))
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%v: got nil error, want %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	tests := []struct {
+		name   string
+		dialer string
+		err    string // substring of the error, or empty if none
+	}{
+		{"main", "", ""},
+		{"dialer", "a", ""},
+		{"direct", "direct", ""},
+		{"unknown name", "nosuch", `unknown name: "nosuch"`},
+		{"bad scheme", "badscheme", `dialer "badscheme"`},
+		{"bad url", "badurl", `dialer "badurl"`},
+		{"bad forward", "badforward", `dialer "badurl"`},
+	}
+
+	c, err := Parse([]byte(`{
+		"dialers": {
+			"a": {"url": "socks5://127.0.0.1:1080"},
+			"b": {"url": "http://127.0.0.1:8080 -> socks5://127.0.0.1:1081", "forward": "a"},
+			"badscheme": {"url": "nosuch://127.0.0.1:1080"},
+			"badurl": {"url": "socks5://127.0.0.1:%zz"},
+			"badforward": {"url": "socks5://127.0.0.1:1080", "forward": "badurl"}
+		},
+		"groups": {
+			"auto": {"strategy": "failover", "dialers": ["a", "b"]}
+		},
+		"main": "auto"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		d, err := c.Dialer(tt.dialer)
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+		case tt.err == "" && d == nil:
+			t.Errorf("%v: got nil dialer", tt.name)
+		case tt.err != "" && err == nil:
+			t.Errorf("%v: got nil error, want %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
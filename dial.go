@@ -53,3 +53,32 @@ func dialFallback(ctx context.Context, d Dialer, network, addr string) (net.Conn
 		return r.Conn, r.Err
 	}
 }
+
+// A BoundAddrConn is a connection that knows the address that a proxy
+// assigned for connecting to the target, for example, the address of a
+// SOCKS5 proxy that is used for egress.
+//
+// Connections returned by socks5, socks5h, socks4 and socks4a Dialers are
+// BoundAddrConns. Connections returned by Dialers that wrap others, like
+// ratelimit, http and httpupgrade Dialers, and load balancing Dialers, are
+// also BoundAddrConns, whose BoundAddr returns what the wrapped connection
+// reports. Connections that run TLS, like those returned by tls and https
+// Dialers, are *tls.Conns, which are not BoundAddrConns; the address is
+// lost for them, and for anything dialed over them.
+type BoundAddrConn interface {
+	net.Conn
+
+	// BoundAddr returns the address that the proxy assigned, or nil if
+	// it is unknown.
+	BoundAddr() net.Addr
+}
+
+// BoundAddr returns the address that the proxy assigned for c if c is a
+// BoundAddrConn, or nil otherwise.
+func BoundAddr(c net.Conn) net.Addr {
+	if bc, ok := c.(BoundAddrConn); ok {
+		return bc.BoundAddr()
+	}
+
+	return nil
+}
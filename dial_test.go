@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testBoundAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 7}
+
+type testBoundConn struct {
+	net.Conn
+}
+
+func (testBoundConn) BoundAddr() net.Addr { return testBoundAddr }
+
+// testBoundDialer is a Dialer that connects to itself, like testRedirect,
+// and returns BoundAddrConns that report testBoundAddr.
+type testBoundDialer string
+
+func (d testBoundDialer) Dial(network, _ string) (net.Conn, error) {
+	c, err := net.Dial(network, string(d))
+	if err != nil {
+		return nil, err
+	}
+
+	return testBoundConn{c}, nil
+}
+
+func TestBoundAddr(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		} else {
+			_, _ = c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+				"Connection: Upgrade\r\n" +
+				"Upgrade: websocket\r\n\r\n"))
+		}
+
+		_, _ = io.Copy(ioutil.Discard, br)
+	})
+
+	for _, u := range []*url.URL{
+		{Scheme: "ratelimit", RawQuery: "r=1M"},
+		{Scheme: "http", Host: server},
+		{Scheme: "httpupgrade", Path: "/"},
+	} {
+		d, err := FromURL(u, testBoundDialer(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		c, err := Dial(ctx, d, "tcp", "192.0.2.1:80")
+
+		cancel()
+
+		if err != nil {
+			t.Fatalf("%v: %v", u.Scheme, err)
+		}
+
+		if a := BoundAddr(c); a != testBoundAddr {
+			t.Errorf("%v: got %v, want %v", u.Scheme, a, testBoundAddr)
+		}
+
+		c.Close()
+	}
+}
@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"net/url"
+)
+
+func init() {
+	proxy_RegisterDialerType("direct", directFromURL)
+}
+
+// directFromURL returns forward as is. It exists so that a chain can
+// explicitly end with "direct://".
+func directFromURL(_ *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	return forward, nil
+}
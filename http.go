@@ -3,16 +3,19 @@ package proxy
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
 func init() {
 	proxy_RegisterDialerType("http", httpFromURL)
+	proxy_RegisterDialerType("https", httpFromURL)
 }
 
 func httpFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
@@ -26,34 +29,152 @@ func httpFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
 		}
 	}
 
+	var tlsConfig *tls.Config
+
+	port := "80"
+
+	if u.Scheme == "https" {
+		var err error
+		if tlsConfig, err = tlsConfigFromURL(u); err != nil {
+			return nil, fmt.Errorf("proxy/http: %w", err)
+		}
+
+		port = "443"
+	}
+
+	header, err := httpParseHeader(u.Query()["header"])
+	if err != nil {
+		return nil, fmt.Errorf("proxy/http: %w", err)
+	}
+
 	host := u.Host
 	if u.Port() == "" {
-		host = net.JoinHostPort(host, "80")
+		host = net.JoinHostPort(host, port)
 	}
 
-	return &httpDialer{host, auth, forward}, nil
+	return &httpDialer{
+		Server:    host,
+		Auth:      auth,
+		Header:    header,
+		TLSConfig: tlsConfig,
+		Forward:   forward,
+	}, nil
+}
+
+// httpParseHeader parses values in the form of "Name: value" as an
+// http.Header.
+func httpParseHeader(values []string) (http.Header, error) {
+	header := make(http.Header)
+
+	for _, v := range values {
+		i := strings.IndexByte(v, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header: %q", v)
+		}
+
+		header.Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	}
+
+	return header, nil
+}
+
+// An HTTPConn is a connection returned by http and https Dialers.
+//
+// An error returned by these Dialers, due to a response with a non-2xx
+// status code, also has a ConnectResponse method.
+type HTTPConn interface {
+	net.Conn
+
+	// ConnectResponse returns the response to the CONNECT request.
+	// The response body is closed.
+	ConnectResponse() *http.Response
 }
 
 type httpDialer struct {
-	Server  string
-	Auth    *proxy_Auth
-	Forward proxy_Dialer
+	Server    string
+	Auth      *proxy_Auth
+	Header    http.Header // extra headers sent with CONNECT requests
+	TLSConfig *tls.Config // if not nil, connects to the proxy with TLS
+	Forward   proxy_Dialer
+
+	mu        sync.Mutex
+	challenge *httpChallenge // the last challenge answered, if any
+	nc        uint32         // the number of times challenge is answered
 }
 
 func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, addr)
 }
 
-func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	default:
 		return nil, fmt.Errorf("proxy/http: network not implemented: %v", network)
 	}
 
+	// Answer the last challenge preemptively, saving a round trip.
+	authorization, answered := d.authorization(addr), false
+
+	for {
+		c, br, resp, err := d.connect(ctx, network, addr, authorization)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return &httpConn{c, br, resp}, nil
+		}
+
+		c.Close()
+
+		// Answer the challenges once on a fresh connection, since
+		// some proxies close the connection after a 407 response.
+		if resp.StatusCode != http.StatusProxyAuthRequired || d.Auth == nil || answered {
+			return nil, &httpStatusError{addr, d.Server, resp}
+		}
+
+		challenge, s, err := httpAuthorize(resp, d.Auth, http.MethodConnect, addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/http: dial %v over %v: %w", addr, d.Server, err)
+		}
+
+		d.mu.Lock()
+		d.challenge, d.nc = &challenge, 1
+		d.mu.Unlock()
+
+		authorization, answered = s, true
+	}
+}
+
+// authorization returns a value for Proxy-Authorization header that answers
+// the last challenge again, or "" if there is none.
+func (d *httpDialer) authorization(addr string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.challenge == nil {
+		return ""
+	}
+
+	d.nc++
+
+	s, err := httpAnswer(*d.challenge, d.Auth, http.MethodConnect, addr, d.nc)
+	if err != nil {
+		return ""
+	}
+
+	return s
+}
+
+// connect sends a CONNECT request with an optional Proxy-Authorization
+// header on a new connection, and returns the connection along with the
+// response, whose body is closed. The returned *bufio.Reader may have read
+// bytes past the response, which must be read before the connection.
+func (d *httpDialer) connect(ctx context.Context, network, addr, authorization string) (c net.Conn, br *bufio.Reader, resp *http.Response, err error) {
 	c, err = Dial(ctx, d.Forward, network, d.Server)
 	if err != nil {
-		return nil, fmt.Errorf("proxy/http: dial %v: %w", d.Server, err)
+		return nil, nil, nil, fmt.Errorf("proxy/http: dial %v: %w", d.Server, err)
 	}
 
 	defer func() {
@@ -90,6 +211,17 @@ func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (c n
 		}(c)
 	}
 
+	if d.TLSConfig != nil {
+		tc := tls.Client(c, d.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+
+			return nil, nil, nil, fmt.Errorf("proxy/http: tls handshake with %v: %w", d.Server, err)
+		}
+
+		c = tc
+	}
+
 	req := &http.Request{
 		Method: http.MethodConnect,
 		URL:    &url.URL{Opaque: addr},
@@ -99,31 +231,92 @@ func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (c n
 		},
 	}
 
-	if d.Auth != nil {
-		authString := d.Auth.User + ":" + d.Auth.Password
-		authString = base64.StdEncoding.EncodeToString([]byte(authString))
-		req.Header.Set("Proxy-Authorization", "Basic "+authString)
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
 	}
 
 	if err := req.Write(c); err != nil {
 		c.Close()
 
-		return nil, fmt.Errorf("proxy/http: dial %v over %v: %w", addr, d.Server, err)
+		return nil, nil, nil, fmt.Errorf("proxy/http: dial %v over %v: %w", addr, d.Server, err)
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	br = bufio.NewReader(c)
+
+	resp, err = http.ReadResponse(br, req)
 	if err != nil {
 		c.Close()
 
-		return nil, fmt.Errorf("proxy/http: dial %v over %v: %w", addr, d.Server, err)
+		return nil, nil, nil, fmt.Errorf("proxy/http: dial %v over %v: %w", addr, d.Server, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		c.Close()
+	return c, br, resp, nil
+}
+
+type httpConn struct {
+	net.Conn
+	br   *bufio.Reader
+	resp *http.Response
+}
+
+// Read reads bytes buffered past the CONNECT response first, which are
+// sent by the target, for example, a server that speaks first.
+func (c *httpConn) Read(b []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(b)
+		}
+
+		c.br = nil
+	}
+
+	return c.Conn.Read(b)
+}
 
-		return nil, fmt.Errorf("proxy/http: dial %v over %v: %v", addr, d.Server, resp.Status)
+// CloseWrite half-closes the connection if the underlying connection
+// supports it.
+func (c *httpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
 
-	return c, nil
+	return fmt.Errorf("proxy/http: close write not supported: %T", c.Conn)
+}
+
+// CloseRead half-closes the connection if the underlying connection
+// supports it.
+func (c *httpConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+
+	return fmt.Errorf("proxy/http: close read not supported: %T", c.Conn)
+}
+
+// BoundAddr returns what the underlying connection reports, if any.
+func (c *httpConn) BoundAddr() net.Addr {
+	return BoundAddr(c.Conn)
+}
+
+func (c *httpConn) ConnectResponse() *http.Response {
+	return c.resp
+}
+
+type httpStatusError struct {
+	addr   string
+	server string
+	resp   *http.Response
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("proxy/http: dial %v over %v: %v", e.addr, e.server, e.resp.Status)
+}
+
+func (e *httpStatusError) ConnectResponse() *http.Response {
+	return e.resp
 }
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveTest serves connections accepted on a new listener with f, and
+// returns the address of the listener.
+func serveTest(t *testing.T, f func(c net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				f(c)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// testRedirect is a Dialer that connects to itself, whatever the address
+// being dialed, for Dialers that use the address to reach the server.
+type testRedirect string
+
+func (d testRedirect) Dial(network, _ string) (net.Conn, error) {
+	return net.Dial(network, string(d))
+}
+
+// testBanner is sent by proxy stand-ins in the same write as the response
+// to a handshake, like a server that speaks first.
+const testBanner = "SSH-2.0-test\r\n"
+
+// testDialBanner dials through a proxy stand-in with d, and checks that
+// testBanner is not lost along with the handshake.
+func testDialBanner(t *testing.T, d Dialer) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, d, "tcp", "192.0.2.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, len(testBanner))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testBanner {
+		t.Errorf("got %q, want %q", b, testBanner)
+	}
+}
+
+func TestHTTPBanner(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+			return
+		}
+
+		_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n" + testBanner))
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "http", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialBanner(t, d)
+}
+
+func TestHTTPPreemptiveAuth(t *testing.T) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+
+	var challenges int32
+
+	server := serveTest(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+
+		if req.Header.Get("Proxy-Authorization") != want {
+			atomic.AddInt32(&challenges, 1)
+
+			_, _ = c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+				"Proxy-Authenticate: Basic realm=\"test\"\r\n" +
+				"Connection: close\r\n\r\n"))
+
+			return
+		}
+
+		_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c, err := Dial(context.Background(), d, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+	}
+
+	if n := atomic.LoadInt32(&challenges); n != 1 {
+		t.Errorf("got %v challenges, want 1", n)
+	}
+}
+
+func TestHTTPDigestAuth(t *testing.T) {
+	const (
+		user  = "us\"er\tname"
+		pass  = "pass"
+		realm = `te"st`
+	)
+
+	var (
+		mu       sync.Mutex
+		nonce    = "n1"
+		answered []string // nonce/nc of accepted answers
+	)
+
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	server := serveTest(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		stale := false
+
+		if cs := httpParseChallenges(req.Header.Values("Proxy-Authorization")); len(cs) == 1 {
+			p := cs[0].Params
+			ha1 := md5hex(p["username"] + ":" + p["realm"] + ":" + pass)
+			ha2 := md5hex(req.Method + ":" + p["uri"])
+			response := md5hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+
+			switch {
+			case p["username"] != user || p["realm"] != realm || p["opaque"] != "op" ||
+				p["qop"] != "auth" || p["response"] != response:
+				t.Errorf("bad answer: %v", req.Header.Get("Proxy-Authorization"))
+			case p["nonce"] != nonce:
+				stale = true
+			default:
+				answered = append(answered, p["nonce"]+"/"+p["nc"])
+				_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+				return
+			}
+		}
+
+		_, _ = fmt.Fprintf(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Digest realm=%v, nonce=%q, qop=\"auth\", opaque=\"op\", stale=%v\r\n"+
+			"Connection: close\r\n\r\n", httpQuote(realm), nonce, stale)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "http", User: url.UserPassword(user, pass), Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			mu.Lock()
+			nonce = "n2"
+			mu.Unlock()
+		}
+
+		c, err := Dial(context.Background(), d, "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{"n1/00000001", "n1/00000002", "n2/00000001"}
+	if strings.Join(answered, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", answered, want)
+	}
+}
+
+func TestHTTPQuote(t *testing.T) {
+	for _, s := range []string{"", "a b", `a"b`, `a\b`, "a\tb", "é"} {
+		cs := httpParseChallenges([]string{"Digest x=" + httpQuote(s)})
+		if len(cs) != 1 || cs[0].Params["x"] != s {
+			t.Errorf("%q: got %v", s, cs)
+		}
+	}
+}
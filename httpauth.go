@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// An httpChallenge is a challenge in a Proxy-Authenticate header.
+type httpChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// httpAuthorize returns a value for Proxy-Authorization header that answers
+// one of the challenges in resp, along with the challenge answered, which
+// can be answered again with httpAnswer. Digest is preferred over Basic.
+func httpAuthorize(resp *http.Response, auth *proxy_Auth, method, uri string) (httpChallenge, string, error) {
+	challenges := httpParseChallenges(resp.Header.Values("Proxy-Authenticate"))
+
+	for _, c := range challenges {
+		if strings.EqualFold(c.Scheme, "Digest") {
+			if s, err := httpDigest(c, auth, method, uri, 1); err == nil {
+				return c, s, nil
+			}
+		}
+	}
+
+	for _, c := range challenges {
+		if strings.EqualFold(c.Scheme, "Basic") {
+			s, err := httpAnswer(c, auth, method, uri, 1)
+			return c, s, err
+		}
+	}
+
+	return httpChallenge{}, "", httpUnsupportedAuthError(resp.Header.Values("Proxy-Authenticate"))
+}
+
+// httpAnswer answers c, a challenge returned by httpAuthorize. nc is the
+// nonce count, which is the number of times that c has been answered.
+func httpAnswer(c httpChallenge, auth *proxy_Auth, method, uri string, nc uint32) (string, error) {
+	if strings.EqualFold(c.Scheme, "Digest") {
+		return httpDigest(c, auth, method, uri, nc)
+	}
+
+	s := auth.User + ":" + auth.Password
+
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(s)), nil
+}
+
+// httpDigest answers a Digest challenge, as defined in RFC 7616.
+func httpDigest(c httpChallenge, auth *proxy_Auth, method, uri string, count uint32) (string, error) {
+	realm, nonce := c.Params["realm"], c.Params["nonce"]
+	if nonce == "" {
+		return "", httpUnsupportedAuthError{"Digest without nonce"}
+	}
+
+	algorithm := c.Params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", httpUnsupportedAuthError{"Digest algorithm=" + algorithm}
+	}
+
+	h := func(s string) string {
+		h := newHash()
+		h.Write([]byte(s))
+
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	var qop string
+
+	if s, ok := c.Params["qop"]; ok {
+		for _, v := range strings.Split(s, ",") {
+			if strings.TrimSpace(v) == "auth" {
+				qop = "auth"
+			}
+		}
+
+		if qop == "" {
+			return "", httpUnsupportedAuthError{"Digest qop=" + s}
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	cnonce := hex.EncodeToString(b)
+
+	nc := fmt.Sprintf("%08x", count)
+
+	ha1 := h(auth.User + ":" + realm + ":" + auth.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	username := auth.User
+	userhash := strings.EqualFold(c.Params["userhash"], "true")
+
+	if userhash {
+		username = h(auth.User + ":" + realm)
+	}
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, `Digest username=%v, realm=%v, nonce=%v, uri=%v, algorithm=%v, response=%v`,
+		httpQuote(username), httpQuote(realm), httpQuote(nonce), httpQuote(uri), algorithm, httpQuote(response))
+
+	if qop != "" {
+		fmt.Fprintf(&sb, `, qop=%v, nc=%v, cnonce=%v`, qop, nc, httpQuote(cnonce))
+	}
+
+	if opaque, ok := c.Params["opaque"]; ok {
+		fmt.Fprintf(&sb, `, opaque=%v`, httpQuote(opaque))
+	}
+
+	if userhash {
+		sb.WriteString(`, userhash=true`)
+	}
+
+	return sb.String(), nil
+}
+
+// httpQuote returns s as a quoted-string, as defined in RFC 7230, in which
+// only " and \ are escaped.
+func httpQuote(s string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+
+		sb.WriteByte(s[i])
+	}
+
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+// httpParseChallenges parses values of Proxy-Authenticate headers, each of
+// which may contain multiple challenges separated by commas.
+func httpParseChallenges(values []string) (challenges []httpChallenge) {
+	for _, s := range values {
+		c := -1
+
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+
+			var token string
+
+			token, s = httpParseToken(s)
+			if token == "" {
+				break // Malformed, give up on this header.
+			}
+
+			rest := strings.TrimLeft(s, " \t")
+			if strings.HasPrefix(rest, "=") && c >= 0 {
+				var value string
+
+				value, s = httpParseValue(strings.TrimLeft(rest[1:], " \t"))
+				challenges[c].Params[strings.ToLower(token)] = value
+
+				continue
+			}
+
+			// token68 credentials are not used by Basic and Digest.
+			challenges = append(challenges, httpChallenge{token, make(map[string]string)})
+			c = len(challenges) - 1
+		}
+	}
+
+	return challenges
+}
+
+func httpParseToken(s string) (token, rest string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], s[i:]
+}
+
+func httpParseValue(s string) (value, rest string) {
+	if !strings.HasPrefix(s, `"`) {
+		return httpParseToken(s)
+	}
+
+	var sb strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return sb.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+
+		sb.WriteByte(s[i])
+	}
+
+	return sb.String(), ""
+}
+
+type httpUnsupportedAuthError []string
+
+func (e httpUnsupportedAuthError) Error() string {
+	return "unsupported proxy authentication: " + strings.Join(e, ", ")
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An HTTPHandler is an HTTP forward proxy. It tunnels CONNECT requests and
+// forwards requests with absolute URIs, making connections with a Dialer.
+type HTTPHandler struct {
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Authenticate specifies an optional function to check a pair of
+	// username and password sent in the Proxy-Authorization header with
+	// Basic scheme. If nil, no authentication is required.
+	Authenticate func(username, password string) bool
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Authenticate != nil && !h.authenticate(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		h.serveConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "proxy/http: not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	h.serveForward(w, r)
+}
+
+func (h *HTTPHandler) authenticate(r *http.Request) bool {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return false
+	}
+
+	fake := &http.Request{Header: http.Header{"Authorization": {auth}}}
+
+	username, password, ok := fake.BasicAuth()
+
+	return ok && h.Authenticate(username, password)
+}
+
+func (h *HTTPHandler) dialer() Dialer {
+	if h.Dialer != nil {
+		return h.Dialer
+	}
+
+	return Direct
+}
+
+func (h *HTTPHandler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "proxy/http: hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	t, err := Dial(r.Context(), h.dialer(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		t.Close()
+		return
+	}
+
+	var noDeadline time.Time
+	_ = c.SetDeadline(noDeadline)
+
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		c.Close()
+		t.Close()
+
+		return
+	}
+
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		if _, err := t.Write(b); err != nil {
+			c.Close()
+			t.Close()
+
+			return
+		}
+	}
+
+	relay(c, t)
+}
+
+func (h *HTTPHandler) serveForward(w http.ResponseWriter, r *http.Request) {
+	h.transportOnce.Do(func() {
+		d := h.dialer()
+		h.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Dial(ctx, d, network, addr)
+			},
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+	})
+
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+
+	if r.ContentLength == 0 {
+		outreq.Body = nil
+	}
+
+	httpRemoveHopHeaders(outreq.Header)
+
+	resp, err := h.transport.RoundTrip(outreq)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	httpRemoveHopHeaders(resp.Header)
+
+	header := w.Header()
+
+	for k, vv := range resp.Header {
+		header[k] = append(header[k], vv...)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// httpHopHeaders are headers that apply only to a single connection, and
+// must not be forwarded by proxies.
+var httpHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func httpRemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+
+	for _, k := range httpHopHeaders {
+		h.Del(k)
+	}
+}
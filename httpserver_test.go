@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHandlerConnect(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+	s := httptest.NewServer(&HTTPHandler{
+		Authenticate: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+	})
+	t.Cleanup(s.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	u, _ := url.Parse(s.URL)
+
+	d, err := FromURL(u, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := Dial(ctx, d, "tcp", echo); err == nil {
+		c.Close()
+		t.Error("dial succeeded without credentials")
+	}
+
+	u.User = url.UserPassword("user", "pass")
+
+	if d, err = FromURL(u, Direct); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(ctx, d, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello" {
+		t.Errorf("got %q, want %q", b, "hello")
+	}
+}
+
+func TestHTTPHandlerHalfClose(t *testing.T) {
+	target := serveTest(t, func(c net.Conn) {
+		b, _ := ioutil.ReadAll(c)
+		_, _ = c.Write(append([]byte("got:"), b...))
+	})
+
+	upstream := httptest.NewServer(&HTTPHandler{})
+	t.Cleanup(upstream.Close)
+
+	u, _ := url.Parse(upstream.URL)
+
+	forward, err := FromURL(u, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(&HTTPHandler{Dialer: forward})
+	t.Cleanup(s.Close)
+
+	if u, err = url.Parse(s.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := FromURL(u, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, d, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("%T has no CloseWrite", c)
+	}
+
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "got:hello" {
+		t.Errorf("got %q, want %q", b, "got:hello")
+	}
+}
+
+func TestHTTPHandlerConnectFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := l.Addr().String()
+	l.Close()
+
+	s := httptest.NewServer(&HTTPHandler{})
+	t.Cleanup(s.Close)
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", closed, closed)
+
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %v, want %v", resp.Status, http.StatusBadGateway)
+	}
+
+	// Dial errors are not revealed to clients.
+	_, port, _ := net.SplitHostPort(closed)
+	if strings.Contains(string(body), port) {
+		t.Errorf("response body reveals the dial error: %q", body)
+	}
+}
+
+func TestHTTPHandlerForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("X-Hop") != "" {
+			http.Error(w, "hop-by-hop headers forwarded", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, "%v %v", r.Method, r.URL.Path)
+	}))
+	t.Cleanup(origin.Close)
+
+	s := httptest.NewServer(&HTTPHandler{})
+	t.Cleanup(s.Close)
+
+	proxyURL, _ := url.Parse(s.URL)
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, origin.URL+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "GET /path" {
+		t.Errorf("got %v %q, want 200 %q", resp.Status, body, "GET /path")
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func init() {
+	proxy_RegisterDialerType("httpupgrade", httpUpgradeFromURL)
+}
+
+// httpUpgradeFromURL returns an httpupgrade Dialer, which sends a GET
+// request with an Upgrade header over a connection to the address being
+// dialed, made by forward, and hands back the raw connection after a 101
+// response. Like a ws Dialer, the host of u, or the address being dialed
+// if empty, is the Host header, and the path and the query of u make up
+// the request URI. The following query parameters are recognized, and
+// removed from the request URI:
+//
+//	host      Host header, defaults to the host of u
+//	header    extra header in the form of "Name: value", can be repeated
+//	upgrade   protocol in the Upgrade header, defaults to websocket
+//	timeout   handshake timeout, like "10s", defaults to 45s
+//
+// For TLS, chain it with a tls Dialer.
+func httpUpgradeFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	values := u.Query()
+
+	header, err := httpParseHeader(values["header"])
+	if err != nil {
+		return nil, fmt.Errorf("proxy/httpupgrade: %w", err)
+	}
+
+	d := &httpUpgradeDialer{
+		Host:    values.Get("host"),
+		Header:  header,
+		Upgrade: values.Get("upgrade"),
+		Timeout: 45 * time.Second,
+		Forward: forward,
+	}
+
+	if d.Host == "" {
+		d.Host = u.Host
+	}
+
+	if d.Upgrade == "" {
+		d.Upgrade = "websocket"
+	}
+
+	if s := values.Get("timeout"); s != "" {
+		if d.Timeout, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("proxy/httpupgrade: timeout: %w", err)
+		}
+	}
+
+	for _, key := range []string{"host", "header", "upgrade", "timeout"} {
+		values.Del(key)
+	}
+
+	d.RequestURI = (&url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: values.Encode()}).RequestURI()
+
+	return d, nil
+}
+
+type httpUpgradeDialer struct {
+	Host       string // if empty, the address being dialed is used
+	RequestURI string
+	Header     http.Header // extra headers sent with upgrade requests
+	Upgrade    string
+	Timeout    time.Duration
+	Forward    proxy_Dialer
+}
+
+func (d *httpUpgradeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpUpgradeDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy/httpupgrade: network not implemented: %v", network)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	c, err = Dial(ctx, d.Forward, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/httpupgrade: dial %v: %w", addr, err)
+	}
+
+	defer func() {
+		if c != nil {
+			var noDeadline time.Time
+			_ = c.SetDeadline(noDeadline)
+		}
+	}()
+
+	if d, ok := ctx.Deadline(); ok && !d.IsZero() {
+		_ = c.SetDeadline(d)
+	}
+
+	if ctx.Done() != nil {
+		watch := make(chan struct{})
+		done := make(chan struct{})
+
+		defer func() {
+			close(done)
+
+			if err == nil {
+				<-watch
+			}
+		}()
+
+		go func(c net.Conn) {
+			defer close(watch)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				aLongTimeAgo := time.Unix(1, 0)
+				_ = c.SetDeadline(aLongTimeAgo)
+			}
+		}(c)
+	}
+
+	host := d.Host
+	if host == "" {
+		host = addr
+	}
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: d.RequestURI},
+		Host:   host,
+		Header: http.Header{
+			"User-Agent": []string(nil),
+		},
+	}
+
+	for k, v := range d.Header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", d.Upgrade)
+
+	if err := req.Write(c); err != nil {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/httpupgrade: dial %v: %w", addr, err)
+	}
+
+	br := bufio.NewReader(c)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/httpupgrade: dial %v: %w", addr, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/httpupgrade: dial %v: %v", addr, resp.Status)
+	}
+
+	// The server must switch to the protocol asked for, rather than
+	// whatever it likes.
+	if !httpHeaderHasToken(resp.Header, "Upgrade", d.Upgrade) {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/httpupgrade: dial %v: unexpected upgrade: %q", addr, resp.Header.Get("Upgrade"))
+	}
+
+	return &httpUpgradeConn{c, br}, nil
+}
+
+// httpUpgradeConn is a connection upgraded by an httpupgrade Dialer.
+type httpUpgradeConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// Read reads bytes buffered past the 101 response first.
+func (c *httpUpgradeConn) Read(b []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(b)
+		}
+
+		c.br = nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// BoundAddr returns what the underlying connection reports, if any.
+func (c *httpUpgradeConn) BoundAddr() net.Addr {
+	return BoundAddr(c.Conn)
+}
+
+// CloseWrite half-closes the connection if the underlying connection
+// supports it.
+func (c *httpUpgradeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return fmt.Errorf("proxy/httpupgrade: close write not supported: %T", c.Conn)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPUpgradeBanner(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+
+		_, _ = c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Upgrade: websocket\r\n\r\n" + testBanner))
+		_, _ = io.Copy(ioutil.Discard, br)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "httpupgrade", Path: "/"}, testRedirect(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialBanner(t, d)
+}
+
+func TestHTTPUpgradeUnexpectedProtocol(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+
+		_, _ = c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Upgrade: h2c\r\n\r\n"))
+		_, _ = io.Copy(ioutil.Discard, br)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "httpupgrade", Path: "/"}, testRedirect(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if c, err := Dial(ctx, d, "tcp", "192.0.2.1:22"); err == nil {
+		c.Close()
+		t.Error("dial succeeded with an unexpected protocol")
+	}
+}
+
+func TestHTTPUpgradeHandler(t *testing.T) {
+	target := serveTest(t, func(c net.Conn) {
+		b, _ := ioutil.ReadAll(c)
+		_, _ = c.Write(append([]byte("got:"), b...))
+	})
+
+	s := httptest.NewServer(&HTTPUpgradeHandler{})
+	t.Cleanup(s.Close)
+
+	d, err := FromURL(&url.URL{Scheme: "httpupgrade", Path: "/", RawQuery: "upgrade=test"},
+		testRedirect(strings.TrimPrefix(s.URL, "http://")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, d, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "got:hello" {
+		t.Errorf("got %q, want %q", b, "got:hello")
+	}
+}
+
+func TestHTTPUpgradeHandlerErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := l.Addr().String()
+	l.Close()
+
+	s := httptest.NewServer(&HTTPUpgradeHandler{Target: closed})
+	t.Cleanup(s.Close)
+
+	for _, tt := range []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{}, http.StatusBadRequest},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, http.StatusBadGateway},
+	} {
+		req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header = tt.header
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("got %v, want %v", resp.Status, tt.status)
+		}
+
+		// Dial errors are not revealed to clients.
+		_, port, _ := net.SplitHostPort(closed)
+		if strings.Contains(string(body), port) {
+			t.Errorf("response body reveals the dial error: %q", body)
+		}
+	}
+}
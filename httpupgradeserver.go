@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An HTTPUpgradeHandler accepts upgrade requests made by httpupgrade
+// Dialers, and relays each upgraded connection to a target connected by a
+// Dialer. Any protocol in the Upgrade header is accepted.
+type HTTPUpgradeHandler struct {
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Target specifies a fixed target address. If empty, the target is
+	// taken from the Host of each request, which is where an httpupgrade
+	// Dialer puts the address it dials, when its URL has no host.
+	Target string
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HTTPUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrade := r.Header.Get("Upgrade")
+	if upgrade == "" || !httpHeaderHasToken(r.Header, "Connection", "upgrade") {
+		http.Error(w, "proxy/httpupgrade: not an upgrade request", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "proxy/httpupgrade: hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	d := h.Dialer
+	if d == nil {
+		d = Direct
+	}
+
+	t, err := Dial(r.Context(), d, "tcp", handlerTarget(r, h.Target))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		t.Close()
+		return
+	}
+
+	var noDeadline time.Time
+	_ = c.SetDeadline(noDeadline)
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + upgrade + "\r\n\r\n"
+	if _, err := io.WriteString(c, resp); err != nil {
+		c.Close()
+		t.Close()
+
+		return
+	}
+
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		if _, err := t.Write(b); err != nil {
+			c.Close()
+			t.Close()
+
+			return
+		}
+	}
+
+	relay(c, t)
+}
+
+// httpHeaderHasToken reports whether any of the comma-separated values of
+// header key is token, case-insensitively.
+func httpHeaderHasToken(header http.Header, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
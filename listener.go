@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// A BindDialer is a means to accept connections via a proxy.
+//
+// Listen asks the proxy to listen on behalf of the caller, and returns a
+// net.Listener whose Addr is the address that the proxy listens on, which
+// is to be told to the peer. addr is the address of the peer that is
+// expected to connect, which proxies may use to restrict incoming
+// connections, or ignore.
+//
+// Some proxies, like SOCKS5 proxies, accept only one connection. Accept
+// on their Listeners fails after a connection is accepted.
+type BindDialer interface {
+	Listen(ctx context.Context, network, addr string) (net.Listener, error)
+}
+
+// Listen calls Listen on d if d is a BindDialer, or returns an error
+// otherwise.
+func Listen(ctx context.Context, d Dialer, network, addr string) (net.Listener, error) {
+	if bd, ok := d.(BindDialer); ok {
+		return bd.Listen(ctx, network, addr)
+	}
+
+	return nil, fmt.Errorf("proxy: listen not implemented: %T", d)
+}
@@ -172,6 +172,11 @@ func (c *conn) Close() error {
 	return c.Conn.Close()
 }
 
+// BoundAddr returns what the wrapped connection reports, if any.
+func (c *conn) BoundAddr() net.Addr {
+	return proxy.BoundAddr(c.Conn)
+}
+
 type dialerHeap []*dialerItem
 
 func (h dialerHeap) Len() int           { return len(h) }
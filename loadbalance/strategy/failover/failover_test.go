@@ -0,0 +1,41 @@
+package failover
+
+import (
+	"net"
+	"testing"
+
+	"github.com/b97tsk/proxy"
+)
+
+var testBoundAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 7}
+
+type testBoundConn struct {
+	net.Conn
+}
+
+func (testBoundConn) BoundAddr() net.Addr { return testBoundAddr }
+
+// testDialer is a Dialer that returns one end of a pipe, as a
+// BoundAddrConn that reports testBoundAddr.
+type testDialer struct{}
+
+func (testDialer) Dial(network, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+
+	return testBoundConn{c1}, nil
+}
+
+func TestBoundAddr(t *testing.T) {
+	d := newDialer([]proxy.Dialer{testDialer{}})
+
+	c, err := d.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if a := proxy.BoundAddr(c); a != testBoundAddr {
+		t.Errorf("got %v, want %v", a, testBoundAddr)
+	}
+}
@@ -0,0 +1,887 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	proxy_RegisterDialerType("mux", muxFromURL)
+}
+
+// muxPingInterval is the default interval of pings, on both sides.
+const muxPingInterval = 30 * time.Second
+
+// muxFromURL returns a mux Dialer, which multiplexes streams over a pool
+// of connections to the MuxServer at the host of u, made by forward. The
+// following query parameters are recognized:
+//
+//	conns     number of connections in the pool, defaults to 2
+//	ping      interval of pings, like "30s", defaults to 30s, 0 disables
+//	pongtimeout
+//	          time to wait for a pong, defaults to the ping interval
+//	idle      time after which a connection with no streams is closed,
+//	          defaults to 5m, 0 disables
+func muxFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy/mux: missing port in %v", u.Host)
+	}
+
+	values := u.Query()
+
+	d := &muxDialer{
+		Server:       u.Host,
+		Conns:        2,
+		PingInterval: muxPingInterval,
+		IdleTimeout:  5 * time.Minute,
+		Forward:      forward,
+	}
+
+	if s := values.Get("conns"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("proxy/mux: invalid conns: %v", s)
+		}
+
+		d.Conns = n
+	}
+
+	for key, p := range map[string]*time.Duration{
+		"ping":        &d.PingInterval,
+		"pongtimeout": &d.PongTimeout,
+		"idle":        &d.IdleTimeout,
+	} {
+		if s := values.Get(key); s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("proxy/mux: %v: %w", key, err)
+			}
+
+			*p = v
+		}
+	}
+
+	d.slots = make([]muxSlot, d.Conns)
+
+	return d, nil
+}
+
+type muxDialer struct {
+	Server       string
+	Conns        int
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	IdleTimeout  time.Duration
+	Forward      proxy_Dialer
+
+	slots []muxSlot
+	next  uint32
+}
+
+// A muxSlot holds a session of the pool, which is replaced with a new one
+// once it fails or is closed.
+type muxSlot struct {
+	mu      sync.Mutex
+	s       *muxSession
+	dialing chan struct{} // closed once the dial in progress is done
+}
+
+func (d *muxDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *muxDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy/mux: network not implemented: %v", network)
+	}
+
+	for retried := false; ; retried = true {
+		s, err := d.session(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/mux: dial %v: %w", d.Server, err)
+		}
+
+		st, err := s.open(ctx, addr)
+		if err == nil {
+			return st, nil
+		}
+
+		// The session failed before the stream was open, for example,
+		// because the connection had gone stale. Retry once on a new one.
+		if !retried && s.failed() && ctx.Err() == nil {
+			continue
+		}
+
+		return nil, fmt.Errorf("proxy/mux: dial %v over %v: %w", addr, d.Server, err)
+	}
+}
+
+// session returns a live session from the pool, in a round-robin manner,
+// connecting a new one if necessary. Callers that need the same new
+// session wait for a single dial, or until ctx is done.
+func (d *muxDialer) session(ctx context.Context) (*muxSession, error) {
+	slot := &d.slots[int(atomic.AddUint32(&d.next, 1)%uint32(len(d.slots)))]
+
+	for {
+		slot.mu.Lock()
+
+		if s := slot.s; s != nil && !s.failed() {
+			slot.mu.Unlock()
+			return s, nil
+		}
+
+		if dialing := slot.dialing; dialing != nil {
+			slot.mu.Unlock()
+
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		dialing := make(chan struct{})
+		slot.dialing = dialing
+		slot.mu.Unlock()
+
+		c, err := Dial(ctx, d.Forward, "tcp", d.Server)
+
+		var s *muxSession
+		if err == nil {
+			s = newMuxSession(c, nil, d.PingInterval, d.PongTimeout, d.IdleTimeout)
+		}
+
+		slot.mu.Lock()
+		if s != nil {
+			slot.s = s
+		}
+		slot.dialing = nil
+		slot.mu.Unlock()
+
+		close(dialing)
+
+		return s, err
+	}
+}
+
+// Frame types. A frame consists of a 9-byte header, which is a type, a
+// stream ID and a length, all big-endian, followed by a payload of length
+// bytes for SYN, PSH and RST frames. For other frames, length is a value.
+const (
+	muxSYN  = 1 // opens a stream, with the target address as the payload
+	muxACK  = 2 // reports that a stream is open
+	muxPSH  = 3 // carries data
+	muxFIN  = 4 // half-closes a stream
+	muxRST  = 5 // aborts a stream, with an optional error message
+	muxWND  = 6 // grants the peer more bytes to send
+	muxPING = 7 // asks for a PONG with the same value, on stream 0
+	muxPONG = 8
+)
+
+const (
+	muxHeaderSize = 9
+	muxMaxPayload = 16 << 10  // for frames that a session sends
+	muxMaxFrame   = 64 << 10  // for frames that a session accepts
+	muxWindow     = 256 << 10 // initial window of each direction of a stream
+)
+
+var (
+	errMuxProtocol    = errors.New("proxy/mux: protocol error")
+	errMuxPongTimeout = errors.New("proxy/mux: pong timeout")
+	errMuxIdle        = errors.New("proxy/mux: idle timeout")
+)
+
+// A muxResetError is the error message in a RST frame.
+type muxResetError string
+
+func (e muxResetError) Error() string {
+	if e == "" {
+		return "stream reset by peer"
+	}
+
+	return string(e)
+}
+
+// A muxSession multiplexes streams over a connection. Streams are opened by
+// clients only. Servers handle them with accept.
+type muxSession struct {
+	conn   net.Conn
+	accept func(st *muxStream, addr string)
+
+	wmu sync.Mutex // serializes writes of frames
+
+	mu        sync.Mutex
+	streams   map[uint32]*muxStream
+	nextID    uint32
+	idleSince time.Time
+	err       error
+
+	done chan struct{} // closed on failure
+	pong chan struct{}
+}
+
+// newMuxSession returns a session over c, and starts reading frames from c.
+// If pingInterval is positive, it sends a ping every pingInterval, and
+// fails if no pong is received in pongTimeout, which defaults to
+// pingInterval. If idleTimeout is positive, it closes itself once it has
+// no streams for idleTimeout.
+func newMuxSession(c net.Conn, accept func(*muxStream, string), pingInterval, pongTimeout, idleTimeout time.Duration) *muxSession {
+	s := &muxSession{
+		conn:      c,
+		accept:    accept,
+		streams:   make(map[uint32]*muxStream),
+		idleSince: time.Now(),
+		done:      make(chan struct{}),
+		pong:      make(chan struct{}, 1),
+	}
+
+	go s.readLoop()
+
+	if pingInterval > 0 || idleTimeout > 0 {
+		if pongTimeout <= 0 {
+			pongTimeout = pingInterval
+		}
+
+		go s.keepAlive(pingInterval, pongTimeout, idleTimeout)
+	}
+
+	return s
+}
+
+func (s *muxSession) failed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail closes the connection, and fails all streams with err. Only the
+// first call has an effect.
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = nil
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+func (s *muxSession) keepAlive(pingInterval, pongTimeout, idleTimeout time.Duration) {
+	interval := pingInterval
+	if interval <= 0 {
+		interval = idleTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if idleTimeout > 0 {
+			s.mu.Lock()
+			idle := len(s.streams) == 0 && time.Since(s.idleSince) >= idleTimeout
+			s.mu.Unlock()
+
+			if idle {
+				s.fail(errMuxIdle)
+				return
+			}
+		}
+
+		if pingInterval <= 0 {
+			continue
+		}
+
+		select { // Discard a late pong.
+		case <-s.pong:
+		default:
+		}
+
+		// Arm the timer before writing, since the write blocks if the
+		// connection stalls, which must fail the session too.
+		timer := time.AfterFunc(pongTimeout, func() { s.fail(errMuxPongTimeout) })
+
+		if s.writeValue(muxPING, 0, 0) != nil {
+			timer.Stop()
+			return
+		}
+
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.pong:
+			timer.Stop()
+		}
+	}
+}
+
+// open opens a stream to addr, and waits for the server to connect to it.
+func (s *muxSession) open(ctx context.Context, addr string) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	s.nextID++
+	st := newMuxStream(s, s.nextID)
+	st.ack = make(chan error, 1)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.write(muxSYN, st.id, []byte(addr)); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-st.ack:
+		if err != nil {
+			return nil, err
+		}
+
+		return st, nil
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.streams[id]; ok {
+		delete(s.streams, id)
+
+		if len(s.streams) == 0 {
+			s.idleSince = time.Now()
+		}
+	}
+}
+
+func (s *muxSession) readLoop() {
+	r := bufio.NewReader(s.conn)
+	hdr := make([]byte, muxHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			s.fail(fmt.Errorf("proxy/mux: read: %w", err))
+			return
+		}
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		n := binary.BigEndian.Uint32(hdr[5:])
+
+		var payload []byte
+
+		switch typ {
+		case muxSYN, muxPSH, muxRST:
+			if n > muxMaxFrame {
+				s.fail(errMuxProtocol)
+				return
+			}
+
+			payload = make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				s.fail(fmt.Errorf("proxy/mux: read: %w", err))
+				return
+			}
+		}
+
+		if err := s.handle(typ, id, n, payload); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handle(typ byte, id, n uint32, payload []byte) error {
+	switch typ {
+	case muxSYN:
+		if s.accept == nil {
+			return errMuxProtocol
+		}
+
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok || s.err != nil {
+			s.mu.Unlock()
+			return errMuxProtocol
+		}
+
+		st := newMuxStream(s, id)
+		s.streams[id] = st
+		s.mu.Unlock()
+
+		go s.accept(st, string(payload))
+	case muxACK:
+		if st := s.stream(id); st != nil && st.ack != nil {
+			select {
+			case st.ack <- nil:
+			default:
+			}
+		}
+	case muxPSH:
+		if st := s.stream(id); st != nil && !st.push(payload) {
+			return errMuxProtocol // The peer exceeded the window.
+		}
+	case muxFIN:
+		if st := s.stream(id); st != nil {
+			st.finish()
+		}
+	case muxRST:
+		if st := s.stream(id); st != nil {
+			s.remove(id)
+			st.fail(muxResetError(payload))
+		}
+	case muxWND:
+		if st := s.stream(id); st != nil {
+			st.grant(n)
+		}
+	case muxPING:
+		// Write in another goroutine, so that reading never blocks on
+		// writing, which would deadlock if the peer did the same.
+		go func() { _ = s.writeValue(muxPONG, 0, n) }()
+	case muxPONG:
+		select {
+		case s.pong <- struct{}{}:
+		default:
+		}
+	default:
+		return errMuxProtocol
+	}
+
+	return nil
+}
+
+// write writes a frame with payload.
+func (s *muxSession) write(typ byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint32(b[5:], uint32(len(payload)))
+	copy(b[muxHeaderSize:], payload)
+
+	return s.writeFrame(b)
+}
+
+// writeValue writes a frame without payload.
+func (s *muxSession) writeValue(typ byte, id, v uint32) error {
+	b := make([]byte, muxHeaderSize)
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint32(b[5:], v)
+
+	return s.writeFrame(b)
+}
+
+func (s *muxSession) writeFrame(b []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.failed() {
+		return s.err
+	}
+
+	if _, err := s.conn.Write(b); err != nil {
+		err = fmt.Errorf("proxy/mux: write: %w", err)
+		s.fail(err)
+
+		return err
+	}
+
+	return nil
+}
+
+// A muxStream is a net.Conn multiplexed in a muxSession. Each direction
+// has a window, which limits bytes in flight, and is granted back as the
+// receiver reads, so that a slow stream does not block others.
+type muxStream struct {
+	s   *muxSession
+	id  uint32
+	ack chan error // receives the result of opening, on clients
+
+	wmu sync.Mutex // serializes Write and sending a FIN
+
+	mu         sync.Mutex
+	rbuf       []byte
+	recvWindow uint32 // bytes that the peer can still send
+	unacked    uint32 // bytes read but not yet granted back
+	sendWindow uint32 // bytes that can still be sent
+	finRecv    bool
+	finSent    bool
+	closed     bool
+	err        error
+	rdeadline  time.Time
+	wdeadline  time.Time
+
+	rnotify chan struct{}
+	wnotify chan struct{}
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		s:          s,
+		id:         id,
+		recvWindow: muxWindow,
+		sendWindow: muxWindow,
+		rnotify:    make(chan struct{}, 1),
+		wnotify:    make(chan struct{}, 1),
+	}
+}
+
+func muxNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// muxWait waits for a notification on ch, or until deadline.
+func muxWait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// push buffers data from the peer. It reports false if data exceeds the
+// window.
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow {
+		return false
+	}
+
+	st.recvWindow -= uint32(len(data))
+
+	if !st.closed {
+		st.rbuf = append(st.rbuf, data...)
+		muxNotify(st.rnotify)
+	}
+
+	return true
+}
+
+// finish handles a FIN from the peer.
+func (st *muxStream) finish() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+
+	muxNotify(st.rnotify)
+
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+// grant handles a window update from the peer.
+func (st *muxStream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+
+	muxNotify(st.wnotify)
+}
+
+// fail fails the stream with err, due to a RST or a session failure.
+func (st *muxStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	if st.ack != nil {
+		select {
+		case st.ack <- err:
+		default:
+		}
+	}
+
+	muxNotify(st.rnotify)
+	muxNotify(st.wnotify)
+}
+
+// reset aborts the stream, sending err to the peer.
+func (st *muxStream) reset(err error) {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+
+	st.s.remove(st.id)
+	_ = st.s.write(muxRST, st.id, []byte(err.Error()))
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+
+		if len(st.rbuf) > 0 {
+			n := copy(b, st.rbuf)
+			if st.rbuf = st.rbuf[n:]; len(st.rbuf) == 0 {
+				st.rbuf = nil
+			}
+
+			st.unacked += uint32(n)
+
+			var grant uint32
+			if st.unacked >= muxWindow/2 && !st.finRecv && st.err == nil {
+				grant, st.unacked = st.unacked, 0
+				st.recvWindow += grant
+			}
+
+			st.mu.Unlock()
+
+			if grant > 0 {
+				_ = st.s.writeValue(muxWND, st.id, grant)
+			}
+
+			return n, nil
+		}
+
+		var err error
+
+		switch {
+		case st.closed:
+			err = fmt.Errorf("proxy/mux: read: %w", net.ErrClosed)
+		case st.finRecv:
+			err = io.EOF
+		case st.err != nil:
+			err = st.err
+		}
+
+		deadline := st.rdeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if err := muxWait(st.rnotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	var written int
+
+	for len(b) > 0 {
+		st.mu.Lock()
+
+		var err error
+
+		switch {
+		case st.closed || st.finSent:
+			err = fmt.Errorf("proxy/mux: write: %w", net.ErrClosed)
+		case st.err != nil:
+			err = st.err
+		}
+
+		if err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.wdeadline
+			st.mu.Unlock()
+
+			if err := muxWait(st.wnotify, deadline); err != nil {
+				return written, err
+			}
+
+			continue
+		}
+
+		n := len(b)
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.s.write(muxPSH, st.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends a FIN, after which the peer reads io.EOF. It waits for
+// a Write in progress, so that the FIN follows all data written.
+func (st *muxStream) CloseWrite() error {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	st.mu.Lock()
+	if st.closed || st.finSent || st.err != nil {
+		err := st.err
+		st.mu.Unlock()
+
+		return err
+	}
+
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+
+	muxNotify(st.wnotify)
+
+	if done {
+		st.s.remove(st.id)
+	}
+
+	return st.s.writeValue(muxFIN, st.id, 0)
+}
+
+// Close closes the stream. It sends a FIN if the peer has sent one, or a
+// RST otherwise, which tells the peer to stop sending.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.closed = true
+	st.rbuf = nil
+
+	var typ byte
+
+	switch {
+	case st.err != nil:
+	case !st.finRecv:
+		typ = muxRST
+	case !st.finSent:
+		typ = muxFIN
+	}
+	st.mu.Unlock()
+
+	muxNotify(st.rnotify)
+	muxNotify(st.wnotify)
+
+	// Wait for a Write in progress, which returns soon after being
+	// notified, so that a FIN follows all data written.
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	st.s.remove(st.id)
+
+	switch typ {
+	case muxRST:
+		return st.s.write(muxRST, st.id, nil)
+	case muxFIN:
+		return st.s.writeValue(muxFIN, st.id, 0)
+	}
+
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+
+	muxNotify(st.rnotify)
+
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+
+	muxNotify(st.wnotify)
+
+	return nil
+}
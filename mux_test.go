@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveTestMux serves a MuxServer, and returns its address along with a
+// channel that receives connections being served.
+func serveTestMux(t *testing.T) (string, chan net.Conn) {
+	conns := make(chan net.Conn, 8)
+	s := &MuxServer{}
+
+	return serveTest(t, func(c net.Conn) {
+		conns <- c
+		s.ServeConn(c)
+	}), conns
+}
+
+func newTestMuxDialer(t *testing.T, server string) Dialer {
+	t.Helper()
+
+	d, err := FromURL(&url.URL{Scheme: "mux", Host: server, RawQuery: "conns=1"}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestMuxRoundTrip(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	server, _ := serveTestMux(t)
+	d := newTestMuxDialer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, d, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// More than a window in each direction, so that the write blocks
+	// until the echo is read.
+	data := make([]byte, 4*muxWindow+1)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	errc := make(chan error, 2)
+
+	go func() {
+		_, err := c.Write(data)
+		errc <- err
+	}()
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// CloseWrite waits for the write in progress, so that the FIN does
+	// not overtake the data.
+	go func() { errc <- c.(interface{ CloseWrite() error }).CloseWrite() }()
+
+	rest, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := append(b, rest...); !bytes.Equal(got, data) {
+		t.Errorf("got %v bytes back, want %v bytes", len(got), len(data))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMuxDialFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := l.Addr().String()
+	l.Close()
+
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	server, conns := serveTestMux(t)
+	d := newTestMuxDialer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = Dial(ctx, d, "tcp", closed)
+
+	var reset muxResetError
+	if !errors.As(err, &reset) {
+		t.Fatalf("got %v, want a muxResetError", err)
+	}
+
+	// The session survives the reset.
+	c, err := Dial(ctx, d, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if n := len(conns); n != 1 {
+		t.Errorf("got %v connections, want 1", n)
+	}
+}
+
+func TestMuxSessionReplacement(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	server, conns := serveTestMux(t)
+
+	var forward testDialCounter
+
+	d, err := FromURL(&url.URL{Scheme: "mux", Host: server, RawQuery: "conns=1"}, &forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		c, err := Dial(ctx, d, "tcp", echo)
+		if err != nil {
+			t.Fatalf("dial #%v: %v", i, err)
+		}
+
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+
+		// Kill the transport. The stream fails, and the next dial
+		// connects a new session.
+		(<-conns).Close()
+
+		if _, err := c.Read(b); err == nil {
+			t.Error("read succeeded on a dead session")
+		}
+
+		c.Close()
+	}
+
+	if n := atomic.LoadInt32(&forward.n); n != 2 {
+		t.Errorf("got %v connections, want 2", n)
+	}
+}
+
+func TestMuxSessionDialCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	// A forward Dialer whose first dial hangs.
+	var n int32
+
+	forward := testDialFunc(func(network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			<-release
+		}
+
+		return nil, errors.New("refused")
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "mux", Host: l.Addr().String(), RawQuery: "conns=1"}, forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _, _ = d.Dial("tcp", "192.0.2.1:80") }()
+
+	for atomic.LoadInt32(&n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Waiting for the hanging dial ends with ctx.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := Dial(ctx, d, "tcp", "192.0.2.1:80")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialContext blocked on another dial")
+	}
+}
+
+func TestMuxPongTimeoutStalled(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// Nothing reads c2, so the ping blocks.
+	s := newMuxSession(c1, nil, 20*time.Millisecond, 20*time.Millisecond, 0)
+
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not fail")
+	}
+
+	if !errors.Is(s.err, errMuxPongTimeout) {
+		t.Errorf("got %v, want %v", s.err, errMuxPongTimeout)
+	}
+}
+
+// testDialFunc is a Dialer that dials with itself.
+type testDialFunc func(network, addr string) (net.Conn, error)
+
+func (f testDialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
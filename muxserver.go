@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// A MuxServer serves mux Dialers. It accepts streams multiplexed over each
+// client connection, and relays each of them to a target connected by a
+// Dialer.
+type MuxServer struct {
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Timeout limits the time spent on dialing each target. Zero means
+	// no timeout.
+	Timeout time.Duration
+
+	// PingInterval specifies how often to send pings, so that sessions
+	// of clients that vanish are closed. If zero, it defaults to 30s. If
+	// negative, no pings are sent. A connection fails if no pong is
+	// received in PongTimeout, which defaults to PingInterval.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+}
+
+// Serve accepts incoming connections on l, serving each of them in a new
+// goroutine. Serve always returns a non-nil error.
+func (s *MuxServer) Serve(l net.Listener) error {
+	return serve(l, s.ServeConn)
+}
+
+// ServeConn serves a single client connection c, and closes it when done.
+func (s *MuxServer) ServeConn(c net.Conn) {
+	ping := s.PingInterval
+	if ping == 0 {
+		ping = muxPingInterval
+	}
+
+	session := newMuxSession(c, s.accept, ping, s.PongTimeout, 0)
+	<-session.done
+}
+
+func (s *MuxServer) accept(st *muxStream, addr string) {
+	ctx := context.Background()
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	d := s.Dialer
+	if d == nil {
+		d = Direct
+	}
+
+	t, err := Dial(ctx, d, "tcp", addr)
+	if err != nil {
+		st.reset(err)
+		return
+	}
+
+	if err := st.s.writeValue(muxACK, st.id, 0); err != nil {
+		t.Close()
+		st.Close()
+
+		return
+	}
+
+	relay(st, t)
+}
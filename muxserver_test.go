@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxServerVanishedClient(t *testing.T) {
+	s := &MuxServer{PingInterval: 50 * time.Millisecond}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		s.ServeConn(c1)
+	}()
+
+	// The client reads pings, but never answers them.
+	go func() { _, _ = io.Copy(ioutil.Discard, c2) }()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+}
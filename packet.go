@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// A PacketDialer is a means to establish packet-oriented connections.
+//
+// ListenPacket announces on the local network address addr, like
+// net.ListenPacket does, and returns a net.PacketConn whose WriteTo sends
+// packets to their destinations via the proxy. Proxies may ignore addr.
+type PacketDialer interface {
+	ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error)
+}
+
+// ListenPacket calls ListenPacket on d if d is a PacketDialer, or returns
+// an error otherwise.
+func ListenPacket(ctx context.Context, d Dialer, network, addr string) (net.PacketConn, error) {
+	if pd, ok := d.(PacketDialer); ok {
+		return pd.ListenPacket(ctx, network, addr)
+	}
+
+	return nil, fmt.Errorf("proxy: listen packet not implemented: %T", d)
+}
+
+var _ PacketDialer = proxy_Direct
+
+// ListenPacket instantiates a net.ListenConfig and invokes its ListenPacket
+// receiver with the supplied parameters.
+func (proxy_direct) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+// packetConnConn is a net.Conn that sends to and receives from a single
+// remote address over a net.PacketConn. Datagrams from other addresses
+// are dropped.
+type packetConnConn struct {
+	net.PacketConn
+	raddr net.Addr
+}
+
+func (c *packetConnConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+
+		if c.accepts(from) {
+			return n, nil
+		}
+	}
+}
+
+// accepts reports whether a datagram from from is from c.raddr. If raddr
+// is a hostname, only ports are compared, since proxies report the IP
+// that it resolves to instead.
+func (c *packetConnConn) accepts(from net.Addr) bool {
+	if from == nil {
+		return false
+	}
+
+	if want, ok := c.raddr.(*net.UDPAddr); ok {
+		got, ok := from.(*net.UDPAddr)
+		return ok && got.IP.Equal(want.IP) && got.Port == want.Port
+	}
+
+	_, want, err := net.SplitHostPort(c.raddr.String())
+	if err != nil {
+		return false
+	}
+
+	_, got, err := net.SplitHostPort(from.String())
+
+	return err == nil && got == want
+}
+
+func (c *packetConnConn) Write(b []byte) (int, error) {
+	return c.PacketConn.WriteTo(b, c.raddr)
+}
+
+func (c *packetConnConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
@@ -2,8 +2,10 @@
 package proxy
 
 import (
+	"fmt"
 	"net"
 	"net/url"
+	"strings"
 )
 
 // A Dialer is a means to establish a connection.
@@ -27,7 +29,30 @@ func FromEnvironment() Dialer {
 // using the provided forwarding Dialer (for instance, a *net.Dialer
 // with desired configuration).
 func FromEnvironmentUsing(forward Dialer) Dialer {
-	return proxy_FromEnvironmentUsing(forward)
+	allProxy := proxy_allProxyEnv.Get()
+	if len(allProxy) == 0 {
+		return forward
+	}
+
+	proxyURL, err := url.Parse(allProxy)
+	if err != nil {
+		return forward
+	}
+
+	proxy, err := FromURL(proxyURL, forward)
+	if err != nil {
+		return forward
+	}
+
+	noProxy := proxy_noProxyEnv.Get()
+	if len(noProxy) == 0 {
+		return proxy
+	}
+
+	perHost := proxy_NewPerHost(proxy, forward)
+	perHost.AddFromString(noProxy)
+
+	return perHost
 }
 
 // RegisterDialerType takes a URL scheme and a function to generate Dialers from
@@ -41,13 +66,60 @@ func RegisterDialerType(scheme string, f func(*url.URL, Dialer) (Dialer, error))
 
 // FromURL returns a Dialer given a URL specification and an underlying
 // Dialer for it to make network requests.
+//
+// Like curl, socks5 resolves hostnames locally and sends IP addresses to
+// the proxy, whereas socks5h (and socks) sends hostnames to the proxy.
 func FromURL(u *url.URL, forward Dialer) (Dialer, error) {
 	switch u.Scheme {
 	case "socks5", "socks5h":
-		u2 := *u
-		u = &u2
-		u.Scheme = "socks"
+		return socksFromURL(u, forward)
 	}
 
 	return proxy_FromURL(u, forward)
 }
+
+// FromURLs returns a Dialer that chains Dialers created from a list of URLs.
+// The first URL is the outermost Dialer, which is the one that a caller
+// dials with, and the last one makes underlying connections using forward.
+// Every URL goes through FromURL, so registered schemes are supported.
+func FromURLs(urls []*url.URL, forward Dialer) (Dialer, error) {
+	d := forward
+
+	for i := len(urls) - 1; i >= 0; i-- {
+		var err error
+
+		d, err = FromURL(urls[i], d)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: chain #%v: %w", i, err)
+		}
+	}
+
+	return d, nil
+}
+
+// ChainSeparator separates URLs in a string accepted by FromChain.
+const ChainSeparator = "->"
+
+// FromChain parses s as a list of URLs separated by ChainSeparator, for
+// example, "ratelimit://?r=1M -> ss://... -> ws://example.com/path", and
+// returns a Dialer created by FromURLs.
+func FromChain(s string, forward Dialer) (Dialer, error) {
+	parts := strings.Split(s, ChainSeparator)
+	urls := make([]*url.URL, 0, len(parts))
+
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("proxy: chain #%v: empty url", i)
+		}
+
+		u, err := url.Parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: chain #%v: %w", i, err)
+		}
+
+		urls = append(urls, u)
+	}
+
+	return FromURLs(urls, forward)
+}
@@ -95,6 +95,35 @@ func (d *rateLimitDialer) DialContext(ctx context.Context, network, addr string)
 	return c, err
 }
 
+func (d *rateLimitDialer) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("proxy/ratelimit: network not implemented: %v", network)
+	}
+
+	c, err := ListenPacket(ctx, d.Forward, network, addr)
+	if err != nil {
+		err = fmt.Errorf("proxy/ratelimit: listen packet %v: %w", addr, err)
+	}
+
+	if err == nil && (d.ReadRate > 0 || d.WriteRate > 0) {
+		l := &rateLimitPacketConn{PacketConn: c}
+
+		if d.ReadRate > 0 {
+			l.r = rate.NewLimiter(rate.Limit(d.ReadRate), rateLimitBurst)
+		}
+
+		if d.WriteRate > 0 {
+			l.w = rate.NewLimiter(rate.Limit(d.WriteRate), rateLimitBurst)
+		}
+
+		c = l
+	}
+
+	return c, err
+}
+
 type rateLimiter struct {
 	net.Conn
 	r, w *rate.Limiter
@@ -125,3 +154,39 @@ func (l *rateLimiter) Write(b []byte) (n int, err error) {
 
 	return
 }
+
+// BoundAddr returns what the wrapped connection reports, if any.
+func (l *rateLimiter) BoundAddr() net.Addr {
+	return BoundAddr(l.Conn)
+}
+
+type rateLimitPacketConn struct {
+	net.PacketConn
+	r, w *rate.Limiter
+}
+
+func (l *rateLimitPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = l.PacketConn.ReadFrom(b)
+	if l.r != nil && err == nil {
+		if l.r.Burst() < len(b) {
+			l.r.SetBurst(len(b))
+		}
+
+		err = l.r.WaitN(context.Background(), n)
+	}
+
+	return
+}
+
+func (l *rateLimitPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	n, err = l.PacketConn.WriteTo(b, addr)
+	if l.w != nil && err == nil {
+		if l.w.Burst() < len(b) {
+			l.w.SetBurst(len(b))
+		}
+
+		err = l.w.WaitN(context.Background(), n)
+	}
+
+	return
+}
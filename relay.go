@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// serve accepts incoming connections on l, calling handle in a new
+// goroutine for each. It retries on temporary errors like net/http does.
+func serve(l net.Listener, handle func(net.Conn)) error {
+	var tempDelay time.Duration
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { //nolint:staticcheck
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+
+				time.Sleep(tempDelay)
+
+				continue
+			}
+
+			return err
+		}
+
+		tempDelay = 0
+
+		go handle(c)
+	}
+}
+
+// relayIdleTimeout bounds how long a direction may stay idle after the
+// other one is done, when the other one cannot be half-closed.
+const relayIdleTimeout = 30 * time.Second
+
+// relay copies data between a and b in both directions until both sides
+// are done, and then closes both.
+//
+// When a direction reaches EOF, its destination is half-closed if it has
+// a CloseWrite method. Otherwise, the peer behind the destination never
+// learns that, so the other direction carries on until it is idle for
+// relayIdleTimeout.
+func relay(a, b net.Conn) {
+	ra := &relayReader{Conn: a, idle: make(chan struct{})}
+	rb := &relayReader{Conn: b, idle: make(chan struct{})}
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go relayCopy(b, ra, rb, &wg)
+	go relayCopy(a, rb, ra, &wg)
+
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+// relayCopy copies from src to dst, where r reads from dst for the other
+// direction.
+func relayCopy(dst net.Conn, src io.Reader, r *relayReader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		// Unblock the other direction, which reads from dst, or writes
+		// to src, which is broken.
+		dst.Close()
+		return
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return
+	}
+
+	r.bound()
+}
+
+// relayReader is a net.Conn whose reads time out after relayIdleTimeout
+// once bound is called.
+type relayReader struct {
+	net.Conn
+	once sync.Once
+	idle chan struct{}
+}
+
+func (r *relayReader) Read(b []byte) (int, error) {
+	select {
+	case <-r.idle:
+		_ = r.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	default:
+	}
+
+	return r.Conn.Read(b)
+}
+
+func (r *relayReader) bound() {
+	r.once.Do(func() {
+		close(r.idle)
+		_ = r.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	})
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// testNoCloseWrite hides the CloseWrite method of a net.Conn, like many
+// wrapping net.Conns do.
+type testNoCloseWrite struct {
+	net.Conn
+}
+
+func TestRelayWithoutCloseWrite(t *testing.T) {
+	// The target never sees EOF, so it replies after reading the request.
+	target := serveTest(t, func(c net.Conn) {
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		_, _ = c.Write(append([]byte("got:"), b...))
+	})
+
+	server := serveTest(t, func(c net.Conn) {
+		tc, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+
+		relay(c, testNoCloseWrite{tc})
+	})
+
+	c, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "got:hello" {
+		t.Errorf("got %q, want %q", b, "got:hello")
+	}
+}
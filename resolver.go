@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewResolver returns a *net.Resolver that sends DNS queries over TCP to
+// nameserver through d, and caches responses for as long as their TTLs.
+// Connections to nameserver are kept for a while and reused.
+//
+// The returned Resolver can be used by a net.Dialer, which in turn can be
+// used as a forwarding Dialer or by an http.Transport, so that hostnames
+// are not resolved by the local resolver.
+func NewResolver(d Dialer, nameserver string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+
+	r := &dnsResolver{
+		Dialer:     d,
+		Nameserver: nameserver,
+		cache:      make(map[string]*dnsCacheEntry),
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dnsConn{r: r}, nil
+		},
+	}
+}
+
+// dnsCacheSize is the maximum number of responses that a dnsResolver
+// caches.
+const dnsCacheSize = 1024
+
+// dnsMaxIdleConns is the maximum number of idle connections to the
+// nameserver that a dnsResolver keeps for reuse.
+const dnsMaxIdleConns = 2
+
+// dnsIdleTimeout is how long an idle connection to the nameserver is kept.
+// Nameservers usually close idle connections after some seconds anyway.
+const dnsIdleTimeout = 10 * time.Second
+
+type dnsResolver struct {
+	Dialer     Dialer
+	Nameserver string
+
+	mu    sync.Mutex
+	cache map[string]*dnsCacheEntry
+	idle  []dnsIdleConn // oldest first
+}
+
+type dnsIdleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// get returns an idle connection to the nameserver, or nil if there is
+// none.
+func (r *dnsResolver) get() net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(r.idle) > 0 && time.Since(r.idle[0].since) >= dnsIdleTimeout {
+		r.idle[0].Close()
+		r.idle = r.idle[1:]
+	}
+
+	if len(r.idle) == 0 {
+		return nil
+	}
+
+	c := r.idle[len(r.idle)-1].Conn
+	r.idle = r.idle[:len(r.idle)-1]
+
+	return c
+}
+
+// put keeps c, a connection to the nameserver, for reuse, or closes it if
+// there are enough idle connections.
+func (r *dnsResolver) put(c net.Conn) {
+	_ = c.SetDeadline(time.Time{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.idle) >= dnsMaxIdleConns {
+		c.Close()
+		return
+	}
+
+	r.idle = append(r.idle, dnsIdleConn{c, time.Now()})
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	ttls    []int // offsets of TTL fields in msg
+	stored  time.Time
+	expires time.Time
+}
+
+// lookup returns a cached response to query, or nil if there is none.
+func (r *dnsResolver) lookup(key string, query []byte) []byte {
+	r.mu.Lock()
+	e := r.cache[key]
+	r.mu.Unlock()
+
+	now := time.Now()
+	if e == nil || !now.Before(e.expires) {
+		return nil
+	}
+
+	msg := append([]byte(nil), e.msg...)
+	copy(msg, query[:2]) // ID
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+
+		binary.BigEndian.PutUint32(msg[off:], ttl)
+	}
+
+	return msg
+}
+
+// store caches msg, a response, for as long as the minimum TTL in it.
+func (r *dnsResolver) store(key string, msg []byte) {
+	if len(msg) < 12 || msg[2]&0x02 != 0 { // truncated
+		return
+	}
+
+	switch msg[3] & 0x0f { // RCODE
+	case 0, 3: // NOERROR, NXDOMAIN
+	default:
+		return
+	}
+
+	ttls, minTTL, err := dnsTTLs(msg)
+	if err != nil || len(ttls) == 0 || minTTL == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &dnsCacheEntry{
+		msg:     msg,
+		ttls:    ttls,
+		stored:  now,
+		expires: now.Add(time.Duration(minTTL) * time.Second),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= dnsCacheSize {
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+
+		for k := range r.cache {
+			if len(r.cache) < dnsCacheSize {
+				break
+			}
+
+			delete(r.cache, k)
+		}
+	}
+
+	r.cache[key] = e
+}
+
+// dnsConn is a net.Conn that a net.Resolver talks to as if it is a TCP
+// connection to a nameserver. It answers queries from the cache, or
+// forwards them to the nameserver through a Dialer.
+type dnsConn struct {
+	r        *dnsResolver
+	upstream net.Conn
+	deadline time.Time
+	wbuf     []byte
+	rbuf     []byte
+	err      error
+	closed   bool
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		return 0, io.EOF
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.wbuf = append(c.wbuf, b...)
+
+	for len(c.wbuf) >= 2 {
+		l := 2 + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < l {
+			break
+		}
+
+		query := c.wbuf[2:l]
+
+		msg, err := c.exchange(query)
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+
+		c.rbuf = append(c.rbuf, byte(len(msg)>>8), byte(len(msg)))
+		c.rbuf = append(c.rbuf, msg...)
+		c.wbuf = c.wbuf[l:]
+	}
+
+	return len(b), nil
+}
+
+func (c *dnsConn) exchange(query []byte) ([]byte, error) {
+	key, err := dnsQuestionKey(query)
+	if err == nil {
+		if msg := c.r.lookup(key, query); msg != nil {
+			return msg, nil
+		}
+	}
+
+	msg, err := c.roundTrip(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		c.r.store(key, append([]byte(nil), msg...))
+	}
+
+	return msg, nil
+}
+
+func (c *dnsConn) roundTrip(query []byte) ([]byte, error) {
+	if c.upstream == nil {
+		if upstream := c.r.get(); upstream != nil {
+			_ = upstream.SetDeadline(c.deadline)
+			c.upstream = upstream
+
+			if msg, err := c.send(query); err == nil {
+				return msg, nil
+			}
+
+			// The nameserver might have closed the connection. Retry
+			// with a new one.
+		}
+
+		ctx := context.Background()
+
+		if !c.deadline.IsZero() {
+			var cancel context.CancelFunc
+
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+			defer cancel()
+		}
+
+		upstream, err := Dial(ctx, c.r.Dialer, "tcp", c.r.Nameserver)
+		if err != nil {
+			return nil, err
+		}
+
+		_ = upstream.SetDeadline(c.deadline)
+		c.upstream = upstream
+	}
+
+	return c.send(query)
+}
+
+// send sends query to the nameserver and reads a response. On error, the
+// connection to the nameserver is closed, since it might be in the middle
+// of a message.
+func (c *dnsConn) send(query []byte) ([]byte, error) {
+	msg, err := dnsSend(c.upstream, query)
+	if err != nil {
+		c.upstream.Close()
+		c.upstream = nil
+	}
+
+	return msg, err
+}
+
+func dnsSend(upstream net.Conn, query []byte) ([]byte, error) {
+	b := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+
+	if _, err := upstream.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(upstream, b[:2]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(upstream, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Close returns the connection to the nameserver, if any, to the
+// dnsResolver for reuse. The connection is always between messages here,
+// since Write waits for responses.
+func (c *dnsConn) Close() error {
+	c.closed = true
+
+	if c.upstream != nil {
+		c.r.put(c.upstream)
+		c.upstream = nil
+	}
+
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return dnsAddr{} }
+func (c *dnsConn) RemoteAddr() net.Addr { return dnsAddr{} }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+
+	if c.upstream != nil {
+		return c.upstream.SetDeadline(t)
+	}
+
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *dnsConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+type dnsAddr struct{}
+
+func (dnsAddr) Network() string { return "dns" }
+func (dnsAddr) String() string  { return "dns" }
+
+var errDNSFormat = errors.New("proxy/dns: malformed message")
+
+// dnsSkipName returns the offset after the domain name at off in msg.
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSFormat
+		}
+
+		l := int(msg[off])
+
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0: // compression pointer
+			if off+2 > len(msg) {
+				return 0, errDNSFormat
+			}
+
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, errDNSFormat
+		}
+
+		off += 1 + l
+	}
+}
+
+// dnsQuestionKey returns a cache key for the only question in query.
+func dnsQuestionKey(query []byte) (string, error) {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return "", errDNSFormat
+	}
+
+	end, err := dnsSkipName(query, 12)
+	if err != nil || end+4 > len(query) {
+		return "", errDNSFormat
+	}
+
+	// A name in a question is never compressed, since nothing precedes it.
+	return strings.ToLower(string(query[12:end])) + string(query[end:end+4]), nil
+}
+
+// dnsTTLs returns offsets of TTL fields of resource records in msg, except
+// OPT pseudo records, along with the minimum TTL. The TTL of an SOA record
+// in the authority section counts as no more than its MINIMUM field, which
+// limits how long negative responses are cached (RFC 2308).
+func dnsTTLs(msg []byte) (offsets []int, minTTL uint32, err error) {
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	rrcount := ancount + nscount + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+
+	for i := 0; i < qdcount; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, 0, err
+		}
+
+		off += 4
+	}
+
+	for i := 0; i < rrcount; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, 0, err
+		}
+
+		if off+10 > len(msg) {
+			return nil, 0, errDNSFormat
+		}
+
+		const (
+			typeSOA = 6
+			typeOPT = 41
+		)
+
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		end := off + 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+
+		if end > len(msg) {
+			return nil, 0, errDNSFormat
+		}
+
+		if typ == typeSOA && i >= ancount && i < ancount+nscount && end-off >= 10+20 {
+			if minimum := binary.BigEndian.Uint32(msg[end-4:]); minimum < ttl {
+				ttl = minimum
+			}
+		}
+
+		if typ != typeOPT {
+			if len(offsets) == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+
+			offsets = append(offsets, off+4)
+		}
+
+		off = end
+	}
+
+	return offsets, minTTL, nil
+}
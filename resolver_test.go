@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNameserver is a stand-in nameserver over TCP. It answers A queries
+// for names starting with "nx" with NXDOMAIN and an SOA record whose TTL is
+// 300 and MINIMUM is 60, and other A queries with 192.0.2.1, with a TTL of
+// 10. Other queries get empty responses.
+type testNameserver struct {
+	addr    string
+	conns   int32
+	queries int32
+}
+
+// serveTestNameserver serves a testNameserver, which closes connections
+// after perConn queries if perConn is positive.
+func serveTestNameserver(t *testing.T, perConn int) *testNameserver {
+	ns := new(testNameserver)
+
+	ns.addr = serveTest(t, func(c net.Conn) {
+		atomic.AddInt32(&ns.conns, 1)
+
+		for i := 0; perConn <= 0 || i < perConn; i++ {
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+
+			query := make([]byte, binary.BigEndian.Uint16(b))
+			if _, err := io.ReadFull(c, query); err != nil {
+				return
+			}
+
+			atomic.AddInt32(&ns.queries, 1)
+
+			msg := testDNSResponse(query)
+
+			b = append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+	})
+
+	return ns
+}
+
+func testDNSResponse(query []byte) []byte {
+	end, _ := dnsSkipName(query, 12)
+	end += 4
+
+	msg := append([]byte(nil), query[:end]...)
+	msg[2], msg[3] = 0x81, 0x80 // response, RD, RA
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint16(msg[8:], 0)
+	binary.BigEndian.PutUint16(msg[10:], 0)
+
+	if binary.BigEndian.Uint16(query[end-4:]) != 1 { // A
+		return msg
+	}
+
+	if strings.HasPrefix(string(query[13:13+query[12]]), "nx") {
+		msg[3] |= 3                             // NXDOMAIN
+		binary.BigEndian.PutUint16(msg[8:], 1)  // NSCOUNT
+		msg = append(msg, 0xc0, 12, 0, 6, 0, 1) // name, SOA, IN
+		msg = append(msg, 0, 0, 0x01, 0x2c)     // TTL 300
+		msg = append(msg, 0, 22, 0, 0)          // RDLENGTH, MNAME, RNAME
+		msg = append(msg, make([]byte, 16)...)  // SERIAL, REFRESH, RETRY, EXPIRE
+		return append(msg, 0, 0, 0, 60)         // MINIMUM 60
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], 1)  // ANCOUNT
+	msg = append(msg, 0xc0, 12, 0, 1, 0, 1) // name, A, IN
+	msg = append(msg, 0, 0, 0, 10)          // TTL 10
+
+	return append(msg, 0, 4, 192, 0, 2, 1)
+}
+
+// testDNSQuery returns an A query for name with id.
+func testDNSQuery(id uint16, name string) []byte {
+	query := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+
+	return append(query, 0, 0, 1, 0, 1)
+}
+
+// testDNSExchange sends query through a new dnsConn of r, and returns the
+// response along with the TTL of its first resource record.
+func testDNSExchange(t *testing.T, r *dnsResolver, query []byte) ([]byte, uint32) {
+	t.Helper()
+
+	c := &dnsConn{r: r}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := b[2:]
+
+	ttls, _, err := dnsTTLs(msg)
+	if err != nil || len(ttls) == 0 {
+		t.Fatalf("got %v records, %v", len(ttls), err)
+	}
+
+	return msg, binary.BigEndian.Uint32(msg[ttls[0]:])
+}
+
+func newTestResolver(ns *testNameserver) *dnsResolver {
+	return &dnsResolver{Dialer: Direct, Nameserver: ns.addr, cache: make(map[string]*dnsCacheEntry)}
+}
+
+// testAge makes cache entries of r older by d.
+func testAge(r *dnsResolver, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.cache {
+		e.stored = e.stored.Add(-d)
+		e.expires = e.expires.Add(-d)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	ns := serveTestNameserver(t, 0)
+	r := newTestResolver(ns)
+
+	tests := []struct {
+		age     time.Duration
+		id      uint16
+		ttl     uint32
+		queries int32
+	}{
+		{0, 1, 10, 1},
+		{0, 2, 10, 1},               // cache hit
+		{3 * time.Second, 3, 7, 1},  // TTL decrements
+		{7 * time.Second, 4, 10, 2}, // expired
+	}
+
+	for i, tt := range tests {
+		testAge(r, tt.age)
+
+		msg, ttl := testDNSExchange(t, r, testDNSQuery(tt.id, "www.example.test"))
+
+		if id := binary.BigEndian.Uint16(msg); id != tt.id {
+			t.Errorf("#%v: got ID %v, want %v", i, id, tt.id)
+		}
+
+		if ttl != tt.ttl {
+			t.Errorf("#%v: got TTL %v, want %v", i, ttl, tt.ttl)
+		}
+
+		if n := atomic.LoadInt32(&ns.queries); n != tt.queries {
+			t.Errorf("#%v: got %v queries, want %v", i, n, tt.queries)
+		}
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	ns := serveTestNameserver(t, 0)
+	r := newTestResolver(ns)
+
+	query := testDNSQuery(1, "nx.example.test")
+
+	testDNSExchange(t, r, query)
+
+	testAge(r, 59*time.Second)
+	testDNSExchange(t, r, query)
+
+	if n := atomic.LoadInt32(&ns.queries); n != 1 {
+		t.Errorf("got %v queries before MINIMUM, want 1", n)
+	}
+
+	testAge(r, time.Second)
+	testDNSExchange(t, r, query)
+
+	if n := atomic.LoadInt32(&ns.queries); n != 2 {
+		t.Errorf("got %v queries after MINIMUM, want 2", n)
+	}
+}
+
+func TestResolverReuse(t *testing.T) {
+	ns := serveTestNameserver(t, 0)
+	r := newTestResolver(ns)
+
+	for i, name := range []string{"a.example.test", "b.example.test", "c.example.test"} {
+		testDNSExchange(t, r, testDNSQuery(uint16(i), name))
+	}
+
+	if n := atomic.LoadInt32(&ns.conns); n != 1 {
+		t.Errorf("got %v connections, want 1", n)
+	}
+}
+
+func TestResolverReuseClosed(t *testing.T) {
+	ns := serveTestNameserver(t, 1)
+	r := newTestResolver(ns)
+
+	for i, name := range []string{"a.example.test", "b.example.test"} {
+		testDNSExchange(t, r, testDNSQuery(uint16(i), name))
+
+		// Let the nameserver close the connection.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&ns.queries); n != 2 {
+		t.Errorf("got %v queries, want 2", n)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	ns := serveTestNameserver(t, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := NewResolver(Direct, ns.addr).LookupIPAddr(ctx, "www.example.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got %v, want [192.0.2.1]", ips)
+	}
+}
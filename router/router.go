@@ -0,0 +1,315 @@
+// Package router provides a Dialer that routes each dial to one of many
+// named Dialers, by evaluating an ordered list of rules.
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/b97tsk/proxy"
+)
+
+// A Rule matches dials by network and address, and names the Dialer to
+// dial with when it matches.
+//
+// A Rule matches if all of its non-empty conditions match. A condition
+// matches if any of its elements matches. A Rule with no conditions
+// matches every dial.
+type Rule struct {
+	// Name is an optional name used for reporting.
+	Name string
+
+	// Domains matches hosts that are exactly one of the domains.
+	Domains []string
+
+	// DomainSuffixes matches hosts that are one of the domains, or one of
+	// their subdomains. For example, "example.com" matches "example.com"
+	// and "www.example.com", but not "badexample.com".
+	DomainSuffixes []string
+
+	// DomainKeywords matches hosts that contain one of the keywords.
+	DomainKeywords []string
+
+	// DomainRegexps matches hosts that match one of the regular
+	// expressions.
+	DomainRegexps []string
+
+	// CIDRs matches IP addresses in one of the networks, for example,
+	// "10.0.0.0/8". Note that only IP addresses being dialed are matched,
+	// hosts are not resolved.
+	CIDRs []string
+
+	// Ports matches ports that are in one of the port ranges, each of
+	// them being either a single port, like "443", or a range, like
+	// "8000-8999".
+	Ports []string
+
+	// Networks matches one of the networks. "tcp" and "udp" also match
+	// their IPv4-only and IPv6-only variants.
+	Networks []string
+
+	// Dialer names the Dialer to dial with.
+	Dialer string
+}
+
+// A Router is a Dialer that routes each dial to a Dialer named by the first
+// Rule that matches, or by the final name if no Rule matches.
+type Router struct {
+	// Report specifies an optional function to be called on every dial,
+	// with the Rule that matches, or nil if no Rule matches.
+	// It must be set before the Router is used.
+	Report func(network, addr string, rule *Rule)
+
+	rules []rule
+	final proxy.Dialer
+}
+
+// New returns a Router given some rules, a name of the Dialer to dial with
+// when no rule matches, and Dialers that are referred to by names.
+func New(rules []Rule, final string, dialers map[string]proxy.Dialer) (*Router, error) {
+	r := new(Router)
+
+	if r.final = dialers[final]; r.final == nil {
+		return nil, fmt.Errorf("proxy/router: final: unknown dialer: %q", final)
+	}
+
+	for i := range rules {
+		rc := rules[i]
+
+		rule, err := compile(&rc, dialers)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/router: rule #%v: %w", i, err)
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// Match returns the first Rule that matches, or nil if no Rule matches,
+// along with the Dialer to dial with.
+func (r *Router) Match(network, addr string) (*Rule, proxy.Dialer) {
+	host, port, err := splitHostPort(addr)
+	if err == nil {
+		for i := range r.rules {
+			if rule := &r.rules[i]; rule.match(network, host, port) {
+				return rule.Rule, rule.dialer
+			}
+		}
+	}
+
+	return nil, r.final
+}
+
+// Dial connects to the address addr on the given network with the Dialer
+// that Match returns.
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network with the
+// Dialer that Match returns, using the provided context.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	rule, d := r.Match(network, addr)
+
+	if r.Report != nil {
+		r.Report(network, addr, rule)
+	}
+
+	return proxy.Dial(ctx, d, network, addr)
+}
+
+func splitHostPort(addr string) (host string, port int, err error) {
+	host, s, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err = strconv.Atoi(s)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port, nil
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+type rule struct {
+	*Rule
+	dialer  proxy.Dialer
+	regexps []*regexp.Regexp
+	nets    []*net.IPNet
+	ports   []portRange
+}
+
+func compile(r *Rule, dialers map[string]proxy.Dialer) (rule rule, err error) {
+	rule.Rule = r
+
+	if rule.dialer = dialers[r.Dialer]; rule.dialer == nil {
+		return rule, fmt.Errorf("unknown dialer: %q", r.Dialer)
+	}
+
+	for _, s := range r.DomainRegexps {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return rule, err
+		}
+
+		rule.regexps = append(rule.regexps, re)
+	}
+
+	for _, s := range r.CIDRs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return rule, err
+		}
+
+		rule.nets = append(rule.nets, n)
+	}
+
+	for _, s := range r.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return rule, err
+		}
+
+		rule.ports = append(rule.ports, pr)
+	}
+
+	return rule, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+
+	var pr portRange
+
+	var err1, err2 error
+
+	pr.lo, err1 = strconv.Atoi(strings.TrimSpace(lo))
+	pr.hi, err2 = strconv.Atoi(strings.TrimSpace(hi))
+
+	if err1 != nil || err2 != nil || pr.lo < 0 || pr.lo > pr.hi || pr.hi > 0xffff {
+		return pr, fmt.Errorf("invalid port range: %q", s)
+	}
+
+	return pr, nil
+}
+
+func (r *rule) match(network, host string, port int) bool {
+	ip := net.ParseIP(host)
+
+	return r.matchNetwork(network) &&
+		r.matchPort(port) &&
+		r.matchCIDR(ip) &&
+		r.matchDomain(host, ip)
+}
+
+func (r *rule) matchNetwork(network string) bool {
+	if len(r.Networks) == 0 {
+		return true
+	}
+
+	for _, s := range r.Networks {
+		if network == s || strings.TrimRight(network, "46") == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+
+	for _, pr := range r.ports {
+		if pr.lo <= port && port <= pr.hi {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rule) matchCIDR(ip net.IP) bool {
+	if len(r.nets) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDomain reports whether all domain conditions match host. Domain
+// conditions never match IP addresses.
+func (r *rule) matchDomain(host string, ip net.IP) bool {
+	if len(r.Domains) == 0 && len(r.DomainSuffixes) == 0 &&
+		len(r.DomainKeywords) == 0 && len(r.regexps) == 0 {
+		return true
+	}
+
+	if ip != nil {
+		return false
+	}
+
+	return matchAny(r.Domains, host, func(s, host string) bool {
+		return strings.EqualFold(strings.TrimSuffix(s, "."), host)
+	}) && matchAny(r.DomainSuffixes, host, func(s, host string) bool {
+		s = strings.ToLower(strings.Trim(s, "."))
+		return host == s || strings.HasSuffix(host, "."+s)
+	}) && matchAny(r.DomainKeywords, host, func(s, host string) bool {
+		return strings.Contains(host, strings.ToLower(s))
+	}) && r.matchRegexp(host)
+}
+
+func (r *rule) matchRegexp(host string) bool {
+	if len(r.regexps) == 0 {
+		return true
+	}
+
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAny reports whether list is empty, or any element of list matches
+// host by match.
+func matchAny(list []string, host string, match func(s, host string) bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+
+	for _, s := range list {
+		if match(s, host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/b97tsk/proxy"
+)
+
+// testDialer is a Dialer that only tells itself apart from others.
+type testDialer string
+
+func (d testDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, errors.New(string(d))
+}
+
+var testDialers = map[string]proxy.Dialer{
+	"a":     testDialer("a"),
+	"b":     testDialer("b"),
+	"final": testDialer("final"),
+}
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{
+			Name:           "suffix and keyword",
+			DomainSuffixes: []string{"example.com"},
+			DomainKeywords: []string{"api"},
+			Dialer:         "a",
+		},
+		{
+			Name:          "domain and regexp",
+			Domains:       []string{"Host.Example.Org."},
+			DomainRegexps: []string{`^host\.`},
+			Dialer:        "a",
+		},
+		{
+			Name:   "cidr and port",
+			CIDRs:  []string{"10.0.0.0/8", "2001:db8::/32"},
+			Ports:  []string{"22", "8000-8999"},
+			Dialer: "b",
+		},
+		{
+			Name:           "udp suffix",
+			Networks:       []string{"udp"},
+			DomainSuffixes: []string{"example.net"},
+			Dialer:         "b",
+		},
+		{
+			Name:   "port only",
+			Ports:  []string{"853"},
+			Dialer: "a",
+		},
+	}
+
+	r, err := New(rules, "final", testDialers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		network, addr string
+		rule          string // name of the rule, or empty if none
+		dialer        string
+	}{
+		{"tcp", "api.example.com:443", "suffix and keyword", "a"},
+		{"tcp", "API.Example.COM.:443", "suffix and keyword", "a"},
+		{"tcp", "www.example.com:443", "", "final"}, // no keyword
+		{"tcp", "api.example.org:443", "", "final"}, // no suffix
+		{"tcp", "api.badexample.com:443", "", "final"},
+		{"tcp", "host.example.org:80", "domain and regexp", "a"},
+		{"tcp", "www.host.example.org:80", "", "final"},
+		{"tcp", "10.1.2.3:22", "cidr and port", "b"},
+		{"tcp", "10.1.2.3:8080", "cidr and port", "b"},
+		{"tcp", "[2001:db8::1]:8999", "cidr and port", "b"},
+		{"tcp", "10.1.2.3:9000", "", "final"},      // port out of range
+		{"tcp", "192.168.1.1:22", "", "final"},     // ip out of range
+		{"tcp", "ten.example.net:22", "", "final"}, // hosts are not resolved
+		{"udp", "www.example.net:53", "udp suffix", "b"},
+		{"udp4", "www.example.net:53", "udp suffix", "b"},
+		{"tcp", "www.example.net:53", "", "final"},
+		{"tcp", "10.1.2.3:853", "port only", "a"},
+		{"tcp", "example.com", "", "final"}, // no port
+	}
+
+	for _, tt := range tests {
+		rule, d := r.Match(tt.network, tt.addr)
+
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+
+		if name != tt.rule || d != testDialers[tt.dialer] {
+			t.Errorf("%v %v: got %q, %v, want %q, %v", tt.network, tt.addr, name, d, tt.rule, tt.dialer)
+		}
+	}
+}
+
+func TestMatchAll(t *testing.T) {
+	r, err := New([]Rule{{Name: "all", Dialer: "a"}}, "final", testDialers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"example.com:80", "10.0.0.1:22", "[::1]:53"} {
+		if rule, d := r.Match("tcp", addr); rule == nil || d != testDialers["a"] {
+			t.Errorf("%v: got %v, %v, want all, a", addr, rule, d)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		final string
+	}{
+		{"unknown final", nil, "nosuch"},
+		{"unknown dialer", []Rule{{Dialer: "nosuch"}}, "final"},
+		{"bad regexp", []Rule{{DomainRegexps: []string{"("}, Dialer: "a"}}, "final"},
+		{"bad cidr", []Rule{{CIDRs: []string{"10.0.0.0"}, Dialer: "a"}}, "final"},
+		{"bad port", []Rule{{Ports: []string{"65536"}, Dialer: "a"}}, "final"},
+		{"reversed port range", []Rule{{Ports: []string{"9000-8000"}, Dialer: "a"}}, "final"},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(tt.rules, tt.final, testDialers); err == nil {
+			t.Errorf("%v: got nil error", tt.name)
+		}
+	}
+}
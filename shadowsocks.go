@@ -18,17 +18,26 @@ func init() {
 }
 
 func shadowsocksFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	server, cipher, err := shadowsocksParseURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shadowsocksDialer{server, cipher, forward}, nil
+}
+
+func shadowsocksParseURL(u *url.URL) (server string, cipher core.Cipher, err error) {
 	origin := u
 
 	if u.User == nil {
 		bytes, err := decodeBase64String(u.Host)
 		if err != nil {
-			return nil, shadowsocksUnknownSSError{origin}
+			return "", nil, shadowsocksUnknownSSError{origin}
 		}
 
 		u, _ = url.Parse(u.Scheme + "://" + string(bytes))
 		if u == nil || u.User == nil {
-			return nil, shadowsocksUnknownSSError{origin}
+			return "", nil, shadowsocksUnknownSSError{origin}
 		}
 	}
 
@@ -38,23 +47,23 @@ func shadowsocksFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error)
 	if !ok {
 		bytes, err := decodeBase64String(method)
 		if err != nil {
-			return nil, shadowsocksUnknownSSError{origin}
+			return "", nil, shadowsocksUnknownSSError{origin}
 		}
 
 		slice := strings.SplitN(string(bytes), ":", 2)
 		if len(slice) != 2 {
-			return nil, shadowsocksUnknownSSError{origin}
+			return "", nil, shadowsocksUnknownSSError{origin}
 		}
 
 		method, password = slice[0], slice[1]
 	}
 
-	cipher, err := core.PickCipher(method, nil, password)
+	cipher, err = core.PickCipher(method, nil, password)
 	if err != nil {
-		return nil, shadowsocksUnknownCipherError{origin}
+		return "", nil, shadowsocksUnknownCipherError{origin}
 	}
 
-	return &shadowsocksDialer{u.Host, cipher, forward}, nil
+	return u.Host, cipher, nil
 }
 
 func decodeBase64String(s string) ([]byte, error) {
@@ -82,6 +91,18 @@ func (d *shadowsocksDialer) Dial(network, addr string) (net.Conn, error) {
 func (d *shadowsocksDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		raddr, err := socksParseAddr(addr)
+		if err != nil {
+			return nil, shadowsocksParseAddrError(addr)
+		}
+
+		pc, err := d.ListenPacket(ctx, network, "")
+		if err != nil {
+			return nil, err
+		}
+
+		return &packetConnConn{pc, socksUDPAddr(raddr)}, nil
 	default:
 		return nil, fmt.Errorf("proxy/shadowsocks: network not implemented: %v", network)
 	}
@@ -142,6 +163,89 @@ func (d *shadowsocksDialer) DialContext(ctx context.Context, network, addr strin
 	return c, nil
 }
 
+// ListenPacket returns a net.PacketConn that sends and receives encrypted
+// datagrams through the UDP relay of the server. Each datagram is prefixed
+// with the address of its destination, or its source.
+func (d *shadowsocksDialer) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("proxy/shadowsocks: network not implemented: %v", network)
+	}
+
+	server, err := net.ResolveUDPAddr(network, d.Server)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/shadowsocks: resolve %v: %w", d.Server, err)
+	}
+
+	pc, err := ListenPacket(ctx, d.Forward, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/shadowsocks: listen packet %v: %w", addr, err)
+	}
+
+	return &shadowsocksPacketConn{d.Cipher.PacketConn(pc), server}, nil
+}
+
+// shadowsocksMaxPacketSize is the size of the buffer that a datagram is
+// read into, which has room for a salt, an address and an AEAD tag.
+const shadowsocksMaxPacketSize = 64 << 10
+
+type shadowsocksPacketConn struct {
+	net.PacketConn
+	server *net.UDPAddr
+}
+
+func (c *shadowsocksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, shadowsocksMaxPacketSize)
+
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			// A datagram that fails to decrypt is returned along with
+			// its source, unlike a failure of reading. Skip it, since it
+			// is likely a stray or spoofed one.
+			if from != nil {
+				continue
+			}
+
+			return 0, nil, err
+		}
+
+		if u, ok := from.(*net.UDPAddr); ok && !(u.IP.Equal(c.server.IP) && u.Port == c.server.Port) {
+			continue // Not from the server.
+		}
+
+		src := socks.SplitAddr(buf[:n])
+		if src == nil {
+			continue
+		}
+
+		a, err := socksParseAddr(src.String())
+		if err != nil {
+			continue
+		}
+
+		return copy(b, buf[len(src):n]), socksUDPAddr(a), nil
+	}
+}
+
+func (c *shadowsocksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst := socks.ParseAddr(addr.String())
+	if dst == nil {
+		return 0, shadowsocksParseAddrError(addr.String())
+	}
+
+	buf := make([]byte, 0, len(dst)+len(b))
+	buf = append(buf, dst...)
+	buf = append(buf, b...)
+
+	if _, err := c.PacketConn.WriteTo(buf, c.server); err != nil {
+		return 0, fmt.Errorf("proxy/shadowsocks: write to %v: %w", addr, err)
+	}
+
+	return len(b), nil
+}
+
 type shadowsocksParseAddrError string
 
 func (e shadowsocksParseAddrError) Error() string {
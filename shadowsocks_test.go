@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// serveTestShadowsocksUDP serves ss UDP clients with a relay that answers
+// each datagram with "got:" and the payload, preceded by a datagram that
+// fails to decrypt. It encrypts and decrypts on its own, since the salt
+// filter in go-shadowsocks2 is shared with clients in the same process.
+func serveTestShadowsocksUDP(t *testing.T, method, password string) string {
+	t.Helper()
+
+	cipher, err := core.PickCipher(method, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead := cipher.(shadowaead.Cipher)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 64<<10)
+
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			salt := buf[:aead.SaltSize()]
+
+			dec, err := aead.Decrypter(salt)
+			if err != nil {
+				continue
+			}
+
+			nonce := make([]byte, dec.NonceSize())
+
+			msg, err := dec.Open(nil, nonce, buf[len(salt):n], nil)
+			if err != nil {
+				continue
+			}
+
+			addr := socks.SplitAddr(msg)
+			if addr == nil {
+				continue
+			}
+
+			junk := make([]byte, 64)
+			_, _ = rand.Read(junk)
+			_, _ = pc.WriteTo(junk, from)
+
+			reply := append(append(append([]byte(nil), addr...), "got:"...), msg[len(addr):]...)
+
+			salt = make([]byte, aead.SaltSize())
+			_, _ = rand.Read(salt)
+
+			enc, err := aead.Encrypter(salt)
+			if err != nil {
+				continue
+			}
+
+			_, _ = pc.WriteTo(enc.Seal(salt, nonce, reply, nil), from)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestShadowsocksListenPacket(t *testing.T) {
+	server := serveTestShadowsocksUDP(t, "AEAD_CHACHA20_POLY1305", "secret")
+
+	d, err := FromURL(&url.URL{Scheme: "ss", User: url.UserPassword("AEAD_CHACHA20_POLY1305", "secret"), Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := ListenPacket(ctx, d, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	if _, err := pc.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 64)
+
+	n, from, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := from.String()+" "+string(b[:n]), "192.0.2.1:53 got:ping"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	c, err := Dial(ctx, d, "udp", target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err = c.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b[:n]) != "got:ping" {
+		t.Errorf("got %q, want %q", b[:n], "got:ping")
+	}
+}
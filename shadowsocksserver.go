@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// A ShadowsocksServer serves Shadowsocks clients. It reads the target
+// address from each client connection and relays it to the target, which
+// is connected by a Dialer.
+//
+// A ShadowsocksServer must be created by NewShadowsocksServer, which sets
+// up its cipher. The zero value serves nothing.
+type ShadowsocksServer struct {
+	// Addr is the server address taken from the URL, which can be used
+	// for listening.
+	Addr string
+
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Timeout limits the time spent on reading the target address and
+	// dialing the target. Zero means no timeout.
+	Timeout time.Duration
+
+	cipher core.Cipher
+	salts  shadowsocksSaltFilter
+}
+
+// NewShadowsocksServer returns a ShadowsocksServer given an ss URL, in the
+// same forms accepted by FromURL.
+func NewShadowsocksServer(u *url.URL) (*ShadowsocksServer, error) {
+	server, cipher, err := shadowsocksParseURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShadowsocksServer{Addr: server, cipher: cipher}, nil
+}
+
+// Serve accepts incoming connections on l, serving each of them in a new
+// goroutine. Serve always returns a non-nil error.
+func (s *ShadowsocksServer) Serve(l net.Listener) error {
+	if s.cipher == nil {
+		return errShadowsocksNoCipher
+	}
+
+	return serve(l, s.ServeConn)
+}
+
+// ServeConn serves a single client connection c, and closes it when done.
+//
+// Connections that reuse a salt seen before, or that fail to decrypt, are
+// drained instead of being closed immediately, so that they look no
+// different from each other to active probes.
+func (s *ShadowsocksServer) ServeConn(c net.Conn) {
+	if s.cipher == nil {
+		c.Close()
+		return
+	}
+
+	ctx := context.Background()
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+
+		_ = c.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	sc, err := s.streamConn(c)
+	if err != nil {
+		s.drain(c)
+		return
+	}
+
+	addr, err := socks.ReadAddr(sc)
+	if err != nil {
+		s.drain(c)
+		return
+	}
+
+	d := s.Dialer
+	if d == nil {
+		d = Direct
+	}
+
+	t, err := Dial(ctx, d, "tcp", addr.String())
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var noDeadline time.Time
+	_ = c.SetDeadline(noDeadline)
+
+	relay(sc, t)
+}
+
+func (s *ShadowsocksServer) streamConn(c net.Conn) (net.Conn, error) {
+	aead, ok := s.cipher.(shadowaead.Cipher)
+	if !ok {
+		return s.cipher.StreamConn(c), nil
+	}
+
+	salt := make([]byte, aead.SaltSize())
+	if _, err := io.ReadFull(c, salt); err != nil {
+		return nil, err
+	}
+
+	if !s.salts.Add(salt) {
+		return nil, shadowsocksRepeatedSaltError{c.RemoteAddr()}
+	}
+
+	dec, err := aead.Decrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypt and decrypt on our own, since the salt filter in
+	// go-shadowsocks2 is shared with clients in the same process.
+	return &shadowsocksServerConn{Conn: c, r: shadowaead.NewReader(c, dec), s: s, aead: aead}, nil
+}
+
+// shadowsocksDrainTimeout bounds draining when ShadowsocksServer.Timeout
+// is zero.
+const shadowsocksDrainTimeout = 30 * time.Second
+
+// drain reads and discards from c until EOF or the deadline, which is
+// set by ServeConn if s.Timeout is positive, and closes c.
+func (s *ShadowsocksServer) drain(c net.Conn) {
+	if s.Timeout <= 0 {
+		_ = c.SetReadDeadline(time.Now().Add(shadowsocksDrainTimeout))
+	}
+
+	_, _ = io.Copy(ioutil.Discard, c)
+	c.Close()
+}
+
+// shadowsocksServerConn is the server side of an AEAD stream connection.
+type shadowsocksServerConn struct {
+	net.Conn
+	r    io.Reader
+	w    io.Writer
+	s    *ShadowsocksServer
+	aead shadowaead.Cipher
+}
+
+func (c *shadowsocksServerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *shadowsocksServerConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		salt := make([]byte, c.aead.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+
+		enc, err := c.aead.Encrypter(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := c.Conn.Write(salt); err != nil {
+			return 0, err
+		}
+
+		// Remember our own salt as well, so that it can not be
+		// reflected back to us.
+		c.s.salts.Add(salt)
+
+		c.w = shadowaead.NewWriter(c.Conn, enc)
+	}
+
+	return c.w.Write(b)
+}
+
+// shadowsocksSaltFilterCapacity is the number of salts that a generation
+// of shadowsocksSaltFilter holds. A salt is remembered for at least this
+// many connections.
+const shadowsocksSaltFilterCapacity = 1 << 16
+
+// shadowsocksSaltFilter remembers salts seen recently. It keeps two
+// generations of salts, and drops the older one when the newer one is full.
+type shadowsocksSaltFilter struct {
+	mu   sync.Mutex
+	cur  map[string]struct{}
+	prev map[string]struct{}
+}
+
+// Add adds salt to the filter. It reports false if salt had been added.
+func (f *shadowsocksSaltFilter) Add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := string(salt)
+
+	if _, ok := f.cur[key]; ok {
+		return false
+	}
+
+	if _, ok := f.prev[key]; ok {
+		return false
+	}
+
+	if len(f.cur) >= shadowsocksSaltFilterCapacity {
+		f.prev, f.cur = f.cur, nil
+	}
+
+	if f.cur == nil {
+		f.cur = make(map[string]struct{})
+	}
+
+	f.cur[key] = struct{}{}
+
+	return true
+}
+
+var errShadowsocksNoCipher = errors.New("proxy/shadowsocks: server not created by NewShadowsocksServer")
+
+type shadowsocksRepeatedSaltError struct {
+	addr net.Addr
+}
+
+func (e shadowsocksRepeatedSaltError) Error() string {
+	return fmt.Sprintf("proxy/shadowsocks: repeated salt from %v", e.addr)
+}
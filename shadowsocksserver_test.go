@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRecorder is a Dialer that records what is written to connections
+// it makes.
+type testRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *testRecorder) Dial(network, addr string) (net.Conn, error) {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testRecorderConn{c, r}, nil
+}
+
+func (r *testRecorder) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]byte(nil), r.buf.Bytes()...)
+}
+
+type testRecorderConn struct {
+	net.Conn
+	r *testRecorder
+}
+
+func (c *testRecorderConn) Write(b []byte) (int, error) {
+	c.r.mu.Lock()
+	c.r.buf.Write(b)
+	c.r.mu.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+func TestShadowsocksServer(t *testing.T) {
+	var accepted int32
+
+	echo := serveTest(t, func(c net.Conn) {
+		atomic.AddInt32(&accepted, 1)
+		_, _ = io.Copy(c, c)
+	})
+
+	s, err := NewShadowsocksServer(&url.URL{Scheme: "ss", User: url.UserPassword("AEAD_CHACHA20_POLY1305", "secret"), Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Timeout = 5 * time.Second
+	server := serveTest(t, s.ServeConn)
+
+	var rec testRecorder
+
+	d, err := FromURL(&url.URL{Scheme: "ss", User: url.UserPassword("AEAD_CHACHA20_POLY1305", "secret"), Host: server}, &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, d, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello" {
+		t.Errorf("got %q, want %q", b, "hello")
+	}
+
+	// Replay what the client sent.
+	rc, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	_ = rc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := rc.Write(rec.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rc.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadAll(rc); err != nil || len(b) > 0 {
+		t.Errorf("replay got %q, %v, want nothing", b, err)
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("target accepted %v connections, want 1", n)
+	}
+}
+
+func TestShadowsocksServerZero(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := new(ShadowsocksServer).Serve(l); err == nil {
+		t.Error("Serve succeeded without a cipher")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	new(ShadowsocksServer).ServeConn(c1)
+
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
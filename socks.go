@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"strconv"
+	"sync"
 )
 
 func init() {
@@ -22,15 +27,44 @@ func socksFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
 		}
 	}
 
-	d, err := proxy_SOCKS5("tcp", u.Host, auth, forward)
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "1080")
+	}
+
+	d, err := proxy_SOCKS5("tcp", server, auth, forward)
 	if err != nil {
 		return nil, fmt.Errorf("proxy/socks: %w", err)
 	}
 
-	return &socksDialer{d}, nil
+	var resolver *net.Resolver
+	if u.Scheme == "socks5" {
+		resolver = socksResolverFromURL(u, forward)
+	}
+
+	return &socksDialer{server, d.(*socks_Dialer), resolver, forward}, nil
+}
+
+// socksResolverFromURL returns a *net.Resolver for resolving hostnames
+// locally. The resolver query parameter of u specifies a nameserver, which
+// is queried through forward.
+func socksResolverFromURL(u *url.URL, forward proxy_Dialer) *net.Resolver {
+	ns := u.Query().Get("resolver")
+	if ns == "" {
+		return net.DefaultResolver
+	}
+
+	return NewResolver(forward, ns)
 }
 
 type socksDialer struct {
+	Server string
+	Dialer *socks_Dialer
+
+	// Resolver resolves hostnames locally if not nil.
+	// Otherwise, hostnames are sent to the proxy.
+	Resolver *net.Resolver
+
 	Forward proxy_Dialer
 }
 
@@ -40,15 +74,264 @@ func (d *socksDialer) Dial(network, addr string) (net.Conn, error) {
 
 func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	switch network {
-	case "tcp", "tcp4", "tcp6":
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
 	default:
 		return nil, fmt.Errorf("proxy/socks: network not implemented: %v", network)
 	}
 
-	c, err := Dial(ctx, d.Forward, network, addr)
+	target, err := socksResolve(ctx, d.Resolver, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks: resolve %v: %w", addr, err)
+	}
+
+	desc := addr
+	if target != addr {
+		desc = fmt.Sprintf("%v (%v)", addr, target)
+	}
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		raddr, err := socksParseAddr(target)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/socks: dial %v: %w", desc, err)
+		}
+
+		pc, err := d.ListenPacket(ctx, network, "")
+		if err != nil {
+			return nil, fmt.Errorf("proxy/socks: dial %v: %w", desc, err)
+		}
+
+		return &packetConnConn{pc, socksUDPAddr(raddr)}, nil
+	}
+
+	c, err := Dial(ctx, d.Dialer, network, target)
 	if err != nil {
-		err = fmt.Errorf("proxy/socks: dial %v: %w", addr, err)
+		err = fmt.Errorf("proxy/socks: dial %v: %w", desc, err)
 	}
 
 	return c, err
 }
+
+// socksResolve returns addr with its host resolved to an IP address by
+// resolver. If resolver is nil, it returns addr as is.
+func socksResolve(ctx context.Context, resolver *net.Resolver, network, addr string) (string, error) {
+	if resolver == nil {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ip := range ips {
+		switch network[len(network)-1] {
+		case '4':
+			if ip.IP.To4() == nil {
+				continue
+			}
+		case '6':
+			if ip.IP.To4() != nil {
+				continue
+			}
+		}
+
+		return net.JoinHostPort(ip.IP.String(), port), nil
+	}
+
+	return "", &net.AddrError{Err: "no suitable address found", Addr: host}
+}
+
+// socksCmdUDPAssociate is the UDP ASSOCIATE command, as defined in RFC 1928.
+const socksCmdUDPAssociate socks_Command = 0x03
+
+// ListenPacket issues a UDP ASSOCIATE command, and returns a net.PacketConn
+// that sends and receives datagrams through the UDP relay of the proxy.
+// The association ends when the returned net.PacketConn is closed, or when
+// the proxy closes the control connection.
+func (d *socksDialer) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("proxy/socks: network not implemented: %v", network)
+	}
+
+	pc, err := ListenPacket(ctx, d.Forward, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks: listen packet %v: %w", addr, err)
+	}
+
+	c, err := Dial(ctx, d.Forward, "tcp", d.Server)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("proxy/socks: dial %v: %w", d.Server, err)
+	}
+
+	associate := *d.Dialer
+	associate.cmd = socksCmdUDPAssociate
+
+	// Tell the proxy where datagrams will come from. The IP is usually
+	// unspecified, which means that the proxy should not restrict it.
+	bound, err := associate.connect(ctx, c, pc.LocalAddr().String())
+	if err != nil {
+		c.Close()
+		pc.Close()
+
+		return nil, fmt.Errorf("proxy/socks: udp associate over %v: %w", d.Server, err)
+	}
+
+	relayAddr, err := socksRelayAddr(bound, d.Server)
+	if err != nil {
+		c.Close()
+		pc.Close()
+
+		return nil, fmt.Errorf("proxy/socks: udp associate over %v: %w", d.Server, err)
+	}
+
+	spc := &socksPacketConn{
+		PacketConn: pc,
+		network:    network,
+		resolver:   d.Resolver,
+		relay:      relayAddr,
+		ctrl:       c,
+	}
+
+	go func() {
+		// The control connection carries no data after the reply.
+		_, _ = io.Copy(ioutil.Discard, c)
+		spc.Close()
+	}()
+
+	return spc, nil
+}
+
+// socksRelayAddr returns the address of the UDP relay given the address
+// in the UDP ASSOCIATE reply. An unspecified IP means that the relay is on
+// the proxy server.
+func socksRelayAddr(bound net.Addr, server string) (*net.UDPAddr, error) {
+	a, ok := bound.(*socks_Addr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected relay address %v", bound)
+	}
+
+	host := a.Name
+
+	switch {
+	case a.IP != nil && !a.IP.IsUnspecified():
+		host = a.IP.String()
+	case a.IP != nil:
+		host, _, _ = net.SplitHostPort(server)
+	}
+
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(a.Port)))
+}
+
+// socksParseAddr parses addr, a host and port pair, as a socks_Addr.
+func socksParseAddr(addr string) (*socks_Addr, error) {
+	host, port, err := socks_splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &socks_Addr{Port: port}
+	if a.IP = net.ParseIP(host); a.IP == nil {
+		a.Name = host
+	}
+
+	return a, nil
+}
+
+// socksUDPAddr returns a as a *net.UDPAddr if it has an IP, or a as is.
+func socksUDPAddr(a *socks_Addr) net.Addr {
+	if a.IP != nil {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+
+	return a
+}
+
+// socksPacketConn is a net.PacketConn that encapsulates datagrams with the
+// UDP request header defined in RFC 1928.
+type socksPacketConn struct {
+	net.PacketConn
+	network   string
+	resolver  *net.Resolver // resolves hostnames locally if not nil
+	relay     *net.UDPAddr
+	ctrl      net.Conn
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+3+1+255+2)
+
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if u, ok := from.(*net.UDPAddr); ok && !(u.IP.Equal(c.relay.IP) && u.Port == c.relay.Port) {
+			continue // Not from the relay.
+		}
+
+		// Drop fragments, since reassembly is not supported.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+
+		a, err := socksReadAddr(r)
+		if err != nil {
+			continue
+		}
+
+		return copy(b, buf[n-r.Len():n]), socksUDPAddr(a), nil
+	}
+}
+
+// WriteTo sends b to addr through the relay. Hostnames are resolved
+// locally if the Dialer resolves them locally.
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*socks_Addr)
+	if !ok || a.IP == nil && c.resolver != nil {
+		target, err := socksResolve(context.Background(), c.resolver, c.network, addr.String())
+		if err != nil {
+			return 0, fmt.Errorf("proxy/socks: write to %v: %w", addr, err)
+		}
+
+		if a, err = socksParseAddr(target); err != nil {
+			return 0, fmt.Errorf("proxy/socks: write to %v: %w", addr, err)
+		}
+	}
+
+	buf := make([]byte, 0, 3+1+255+2+len(b))
+	buf = append(buf, 0, 0, 0)
+	buf = socksAppendAddr(buf, a)
+	buf = append(buf, b...)
+
+	if _, err := c.PacketConn.WriteTo(buf, c.relay); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *socksPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		c.closeErr = c.PacketConn.Close()
+	})
+
+	return c.closeErr
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func init() {
+	proxy_RegisterDialerType("socks4", socks4FromURL)
+	proxy_RegisterDialerType("socks4a", socks4FromURL)
+}
+
+func socks4FromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "1080")
+	}
+
+	var userID string
+	if u.User != nil {
+		userID = u.User.Username()
+	}
+
+	var resolver *net.Resolver
+	if u.Scheme == "socks4" {
+		resolver = socksResolverFromURL(u, forward)
+	}
+
+	return &socks4Dialer{server, userID, resolver, forward}, nil
+}
+
+type socks4Dialer struct {
+	Server string
+	UserID string
+
+	// Resolver resolves hostnames locally if not nil (SOCKS4).
+	// Otherwise, hostnames are sent to the proxy (SOCKS4a).
+	Resolver *net.Resolver
+
+	Forward proxy_Dialer
+}
+
+func (d *socks4Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *socks4Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("proxy/socks4: network not implemented: %v", network)
+	}
+
+	target, err := socksResolve(ctx, d.Resolver, "tcp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks4: resolve %v: %w", addr, err)
+	}
+
+	req, err := d.request(target)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks4: dial %v: %w", addr, err)
+	}
+
+	c, err = Dial(ctx, d.Forward, "tcp", d.Server)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks4: dial %v: %w", d.Server, err)
+	}
+
+	defer func() {
+		if c != nil {
+			var noDeadline time.Time
+			_ = c.SetDeadline(noDeadline)
+		}
+	}()
+
+	if d, ok := ctx.Deadline(); ok && !d.IsZero() {
+		_ = c.SetDeadline(d)
+	}
+
+	if ctx.Done() != nil {
+		watch := make(chan struct{})
+		done := make(chan struct{})
+
+		defer func() {
+			close(done)
+
+			if err == nil {
+				<-watch
+			}
+		}()
+
+		go func(c net.Conn) {
+			defer close(watch)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				aLongTimeAgo := time.Unix(1, 0)
+				_ = c.SetDeadline(aLongTimeAgo)
+			}
+		}(c)
+	}
+
+	desc := addr
+	if target != addr {
+		desc = fmt.Sprintf("%v (%v)", addr, target)
+	}
+
+	if _, err := c.Write(req); err != nil {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/socks4: dial %v over %v: %w", desc, d.Server, err)
+	}
+
+	// The reply is exactly 8 bytes, nothing past it is read.
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/socks4: dial %v over %v: %w", desc, d.Server, err)
+	}
+
+	if b[0] != 0 {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/socks4: dial %v over %v: unexpected reply version %v", desc, d.Server, b[0])
+	}
+
+	if code := socks4Reply(b[1]); code != socks4Granted {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/socks4: dial %v over %v: %w", desc, d.Server, code)
+	}
+
+	bound := &socks_Addr{IP: net.IP(b[4:8]), Port: int(b[2])<<8 | int(b[3])}
+
+	return &socks_Conn{Conn: c, boundAddr: bound}, nil
+}
+
+// request returns a CONNECT request to addr. If the host of addr is not an
+// IPv4 address, it is sent as a hostname, as defined in SOCKS4a.
+func (d *socks4Dialer) request(addr string) ([]byte, error) {
+	host, port, err := socks_splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, 8+len(d.UserID)+1+len(host)+1)
+	b = append(b, socks4Version, socks4CmdConnect, byte(port>>8), byte(port))
+
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip.To4() != nil:
+		b = append(b, ip.To4()...)
+	case ip != nil:
+		return nil, &net.AddrError{Err: "IPv6 not supported", Addr: host}
+	default:
+		// An invalid IP address 0.0.0.x tells the proxy that a hostname
+		// follows the user ID.
+		b = append(b, 0, 0, 0, 1)
+	}
+
+	b = append(b, d.UserID...)
+	b = append(b, 0)
+
+	if ip == nil {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+
+	return b, nil
+}
+
+// Wire protocol constants.
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+)
+
+// A socks4Reply represents a SOCKS4 reply code. A socks4Reply other than
+// socks4Granted is an error.
+type socks4Reply byte
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted        socks4Reply = 0x5a
+	socks4Rejected       socks4Reply = 0x5b
+	socks4NoIdentd       socks4Reply = 0x5c
+	socks4IdentdMismatch socks4Reply = 0x5d
+)
+
+func (code socks4Reply) String() string {
+	switch code {
+	case socks4Granted:
+		return "request granted"
+	case socks4Rejected:
+		return "request rejected or failed"
+	case socks4NoIdentd:
+		return "request rejected because SOCKS server cannot connect to identd on the client"
+	case socks4IdentdMismatch:
+		return "request rejected because the client program and identd report different user-ids"
+	default:
+		return "unknown code: " + strconv.Itoa(int(code))
+	}
+}
+
+func (code socks4Reply) Error() string {
+	return code.String()
+}
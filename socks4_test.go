@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestSOCKS4Banner(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return
+		}
+
+		if _, err := br.ReadBytes(0); err != nil { // User ID.
+			return
+		}
+
+		reply := []byte{0, byte(socks4Granted), 0, 0, 0, 0, 0, 0}
+
+		_, _ = c.Write(append(reply, testBanner...))
+		_, _ = io.Copy(ioutil.Discard, br)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "socks4", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialBanner(t, d)
+}
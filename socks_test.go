@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSOCKSBanner(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		b := make([]byte, 3+1+255+2)
+
+		// Method negotiation.
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+			return
+		}
+
+		if _, err := c.Write([]byte{socks_Version5, byte(socks_AuthMethodNotRequired)}); err != nil {
+			return
+		}
+
+		// Request.
+		if _, err := io.ReadFull(c, b[:3]); err != nil {
+			return
+		}
+
+		if _, err := socksReadAddr(c); err != nil {
+			return
+		}
+
+		reply := []byte{socks_Version5, byte(socks_StatusSucceeded), 0, socks_AddrTypeIPv4, 0, 0, 0, 0, 0, 0}
+
+		_, _ = c.Write(append(reply, testBanner...))
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "socks", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialBanner(t, d)
+}
+
+// serveTestUDPAssociate serves UDP ASSOCIATE requests with a relay that
+// answers each datagram with "got:" and the payload, preceded by a reply
+// from a stranger.
+func serveTestUDPAssociate(t *testing.T) string {
+	return serveTest(t, func(c net.Conn) {
+		b := make([]byte, 3+1+255+2)
+
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+			return
+		}
+
+		if _, err := c.Write([]byte{socks_Version5, byte(socks_AuthMethodNotRequired)}); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(c, b[:3]); err != nil || b[1] != byte(socksCmdUDPAssociate) {
+			return
+		}
+
+		if _, err := socksReadAddr(c); err != nil {
+			return
+		}
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer pc.Close()
+
+		// An unspecified IP means the relay is on the proxy server.
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		reply := []byte{socks_Version5, byte(socks_StatusSucceeded), 0, socks_AddrTypeIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)}
+
+		if _, err := c.Write(reply); err != nil {
+			return
+		}
+
+		go func() {
+			buf := make([]byte, 2048)
+
+			for {
+				n, from, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				r := bytes.NewReader(buf[3:n])
+
+				a, err := socksReadAddr(r)
+				if err != nil {
+					continue
+				}
+
+				payload := buf[n-r.Len() : n]
+
+				stranger := socksAppendAddr([]byte{0, 0, 0}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: a.Port})
+				_, _ = pc.WriteTo(append(stranger, "stranger"...), from)
+
+				msg := socksAppendAddr([]byte{0, 0, 0}, a)
+				msg = append(msg, "got:"...)
+				_, _ = pc.WriteTo(append(msg, payload...), from)
+			}
+		}()
+
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	server := serveTestUDPAssociate(t)
+
+	d, err := FromURL(&url.URL{Scheme: "socks", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := ListenPacket(ctx, d, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	if _, err := pc.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 64)
+
+	for _, want := range []string{"192.0.2.9:53 stranger", "192.0.2.1:53 got:ping"} {
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := from.String() + " " + string(b[:n]); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// A connected UDP conn drops datagrams from others.
+	c, err := Dial(ctx, d, "udp", target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b[:n]) != "got:ping" {
+		t.Errorf("got %q, want %q", b[:n], "got:ping")
+	}
+}
+
+func TestSOCKSRelayAddr(t *testing.T) {
+	if _, err := socksRelayAddr(&net.TCPAddr{}, "127.0.0.1:1080"); err == nil {
+		t.Error("got no error for an unexpected address type")
+	}
+
+	a, err := socksRelayAddr(&socks_Addr{IP: net.IPv4zero, Port: 1234}, "127.0.0.1:1080")
+	if err != nil || a.String() != "127.0.0.1:1234" {
+		t.Errorf("got %v, %v, want 127.0.0.1:1234", a, err)
+	}
+}
+
+func TestSOCKSUDPResolve(t *testing.T) {
+	server := serveTestUDPAssociate(t)
+
+	d, err := FromURL(&url.URL{Scheme: "socks5", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := ListenPacket(ctx, d, "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := pc.WriteTo([]byte("ping"), &socks_Addr{Name: "localhost", Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 64)
+
+	for _, want := range []string{"192.0.2.9:53 stranger", "127.0.0.1:53 got:ping"} {
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := from.String() + " " + string(b[:n]); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// testDialRecorder is a Dialer that records addresses being dialed, and
+// fails.
+type testDialRecorder struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *testDialRecorder) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.addrs = append(d.addrs, addr)
+
+	return nil, errors.New("refused")
+}
+
+func TestSOCKSResolverForward(t *testing.T) {
+	var forward testDialRecorder
+
+	u := &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080", RawQuery: "resolver=192.0.2.53"}
+
+	d, err := FromURL(u, &forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := Dial(ctx, d, "tcp", "example.invalid:80"); err == nil {
+		t.Fatal("got no error")
+	}
+
+	forward.mu.Lock()
+	defer forward.mu.Unlock()
+
+	if len(forward.addrs) == 0 {
+		t.Fatal("the nameserver was not dialed through forward")
+	}
+
+	for _, addr := range forward.addrs {
+		if addr != "192.0.2.53:53" {
+			t.Errorf("got %v, want 192.0.2.53:53", addr)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ BindDialer = (*socksDialer)(nil)
+
+// Listen issues a BIND command, and returns a net.Listener whose Addr is
+// the address that the proxy listens on. Accept returns the first, and the
+// only, connection that the proxy accepts. addr is the address of the peer
+// that is expected to connect, it may have an unspecified IP or port.
+func (d *socksDialer) Listen(ctx context.Context, network, addr string) (_ net.Listener, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy/socks: network not implemented: %v", network)
+	}
+
+	// An empty host, which means any peer, is not to be resolved.
+	target := addr
+	if host, _, _ := net.SplitHostPort(addr); host != "" {
+		if target, err = socksResolve(ctx, d.Resolver, network, addr); err != nil {
+			return nil, fmt.Errorf("proxy/socks: resolve %v: %w", addr, err)
+		}
+	}
+
+	desc := addr
+	if target != addr {
+		desc = fmt.Sprintf("%v (%v)", addr, target)
+	}
+
+	peer, err := socksParseBindAddr(target)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks: bind %v: %w", desc, err)
+	}
+
+	c, err := Dial(ctx, d.Forward, "tcp", d.Server)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/socks: dial %v: %w", d.Server, err)
+	}
+
+	defer func() {
+		if err == nil {
+			var noDeadline time.Time
+			_ = c.SetDeadline(noDeadline)
+		}
+	}()
+
+	if d, ok := ctx.Deadline(); ok && !d.IsZero() {
+		_ = c.SetDeadline(d)
+	}
+
+	if ctx.Done() != nil {
+		watch := make(chan struct{})
+		done := make(chan struct{})
+
+		defer func() {
+			close(done)
+
+			if err == nil {
+				<-watch
+			}
+		}()
+
+		go func(c net.Conn) {
+			defer close(watch)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				aLongTimeAgo := time.Unix(1, 0)
+				_ = c.SetDeadline(aLongTimeAgo)
+			}
+		}(c)
+	}
+
+	bound, err := d.request(ctx, c, socks_cmdBind, peer)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy/socks: bind %v over %v: %w", desc, d.Server, err)
+	}
+
+	// Like a UDP relay, an unspecified IP means the proxy server itself.
+	if bound.IP != nil && bound.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(d.Server)
+		if ip := net.ParseIP(host); ip != nil {
+			bound.IP = ip
+		} else {
+			bound.IP, bound.Name = nil, host
+		}
+	}
+
+	return &socksListener{c: c, addr: socksTCPAddr(bound)}, nil
+}
+
+// request sends a request of the command cmd to addr on c after the
+// method negotiation, and returns the address in the reply. Unlike
+// socks_Dialer.connect, addr may have a zero port.
+func (d *socksDialer) request(ctx context.Context, c net.Conn, cmd socks_Command, addr *socks_Addr) (*socks_Addr, error) {
+	b := make([]byte, 0, 3+1+255+2)
+	b = append(b, socks_Version5)
+
+	if len(d.Dialer.AuthMethods) == 0 || d.Dialer.Authenticate == nil {
+		b = append(b, 1, byte(socks_AuthMethodNotRequired))
+	} else {
+		ams := d.Dialer.AuthMethods
+		if len(ams) > 255 {
+			return nil, errors.New("too many authentication methods")
+		}
+
+		b = append(b, byte(len(ams)))
+		for _, am := range ams {
+			b = append(b, byte(am))
+		}
+	}
+
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+
+	if b[0] != socks_Version5 {
+		return nil, errors.New("unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+
+	am := socks_AuthMethod(b[1])
+	if am == socks_AuthMethodNoAcceptableMethods {
+		return nil, errors.New("no acceptable authentication methods")
+	}
+
+	if d.Dialer.Authenticate != nil {
+		if err := d.Dialer.Authenticate(ctx, c, am); err != nil {
+			return nil, err
+		}
+	}
+
+	b = append(b[:0], socks_Version5, byte(cmd), 0)
+	b = socksAppendAddr(b, addr)
+
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	return socksReadReply(c)
+}
+
+// socksReadReply reads a reply, and returns the address in it if the reply
+// indicates success.
+func socksReadReply(r io.Reader) (*socks_Addr, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	if b[0] != socks_Version5 {
+		return nil, errors.New("unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+
+	if code := socks_Reply(b[1]); code != socks_StatusSucceeded {
+		return nil, errors.New("unknown error " + code.String())
+	}
+
+	if b[2] != 0 {
+		return nil, errors.New("non-zero reserved field")
+	}
+
+	return socksReadAddr(r)
+}
+
+// socksParseBindAddr is like socksParseAddr, but allows an empty host and
+// a zero port.
+func socksParseBindAddr(addr string) (*socks_Addr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	portnum, err := strconv.Atoi(port)
+	if err != nil || portnum < 0 || portnum > 0xffff {
+		return nil, errors.New("port number out of range " + port)
+	}
+
+	a := &socks_Addr{Port: portnum}
+
+	switch {
+	case host == "":
+		a.IP = net.IPv4zero
+	default:
+		if a.IP = net.ParseIP(host); a.IP == nil {
+			a.Name = host
+		}
+	}
+
+	return a, nil
+}
+
+// socksTCPAddr returns a as a *net.TCPAddr if it has an IP, or a as is.
+func socksTCPAddr(a *socks_Addr) net.Addr {
+	if a.IP != nil {
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+
+	return a
+}
+
+// socksListener is a net.Listener that accepts the connection announced
+// by the second reply to a BIND command.
+type socksListener struct {
+	c    net.Conn
+	addr net.Addr
+
+	mu        sync.Mutex
+	accepting bool
+	closed    bool
+}
+
+// Accept waits for the proxy to accept a connection. Once it returns, the
+// listener is closed, and later calls return an error wrapping
+// net.ErrClosed.
+func (l *socksListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.accepting || l.closed {
+		l.mu.Unlock()
+		return nil, l.opError(net.ErrClosed)
+	}
+
+	l.accepting = true
+	l.mu.Unlock()
+
+	remote, err := socksReadReply(l.c)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, l.opError(net.ErrClosed)
+	}
+
+	l.closed = true
+
+	if err != nil {
+		l.c.Close()
+		return nil, l.opError(err)
+	}
+
+	return &socksBindConn{l.c, l.addr, socksTCPAddr(remote)}, nil
+}
+
+// Close closes the control connection, unless a connection is accepted,
+// which takes over the control connection.
+func (l *socksListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+
+	return l.c.Close()
+}
+
+func (l *socksListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *socksListener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: err}
+}
+
+// socksBindConn is a connection accepted by a socksListener.
+type socksBindConn struct {
+	net.Conn
+	boundAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// BoundAddr returns the address that the proxy listened on.
+func (c *socksBindConn) BoundAddr() net.Addr {
+	return c.boundAddr
+}
+
+// RemoteAddr returns the address of the peer, as reported by the proxy.
+func (c *socksBindConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSOCKSListen(t *testing.T) {
+	requests := make(chan *socks_Addr, 1)
+
+	server := serveTest(t, func(c net.Conn) {
+		b := make([]byte, 3+1+255+2)
+
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+			return
+		}
+
+		if _, err := c.Write([]byte{socks_Version5, byte(socks_AuthMethodNotRequired)}); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(c, b[:3]); err != nil || b[1] != byte(socks_cmdBind) {
+			return
+		}
+
+		a, err := socksReadAddr(c)
+		if err != nil {
+			return
+		}
+
+		requests <- a
+
+		// Listening on an unspecified IP, port 1234.
+		b = []byte{socks_Version5, byte(socks_StatusSucceeded), 0, socks_AddrTypeIPv4, 0, 0, 0, 0, 0x04, 0xd2}
+		if _, err := c.Write(b); err != nil {
+			return
+		}
+
+		// Accepted from 192.0.2.2:5678.
+		b = []byte{socks_Version5, byte(socks_StatusSucceeded), 0, socks_AddrTypeIPv4, 192, 0, 2, 2, 0x16, 0x2e}
+		if _, err := c.Write(append(b, testBanner...)); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(ioutil.Discard, c)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "socks5", Host: server}, Direct) // Resolves locally.
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := Listen(ctx, d, "tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if a := <-requests; !a.IP.Equal(net.IPv4zero) || a.Port != 0 {
+		t.Errorf("got request for %v, want 0.0.0.0:0", a)
+	}
+
+	if got, want := l.Addr().String(), "127.0.0.1:1234"; got != want {
+		t.Errorf("got listener address %v, want %v", got, want)
+	}
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got, want := c.RemoteAddr().String(), "192.0.2.2:5678"; got != want {
+		t.Errorf("got remote address %v, want %v", got, want)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, len(testBanner))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != testBanner {
+		t.Errorf("got %q, want %q", b, testBanner)
+	}
+
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept succeeded twice")
+	}
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS reply codes, as defined in RFC 1928.
+const (
+	socksReplyGeneralFailure       socks_Reply = 0x01
+	socksReplyNotAllowed           socks_Reply = 0x02
+	socksReplyNetworkUnreachable   socks_Reply = 0x03
+	socksReplyHostUnreachable      socks_Reply = 0x04
+	socksReplyConnectionRefused    socks_Reply = 0x05
+	socksReplyCommandNotSupported  socks_Reply = 0x07
+	socksReplyAddrTypeNotSupported socks_Reply = 0x08
+)
+
+// A SOCKSServer serves SOCKS version 5 clients (RFC 1928), optionally
+// with username/password authentication (RFC 1929). It serves CONNECT
+// requests by dialing targets with a Dialer.
+type SOCKSServer struct {
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Authenticate specifies an optional function to check a pair of
+	// username and password. If nil, no authentication is required.
+	Authenticate func(username, password string) bool
+
+	// Timeout limits the time spent on a handshake, including dialing
+	// the target. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Serve accepts incoming connections on l, serving each of them in a new
+// goroutine. Serve always returns a non-nil error.
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	return serve(l, s.ServeConn)
+}
+
+// ServeConn serves a single client connection c, and closes it when done.
+func (s *SOCKSServer) ServeConn(c net.Conn) {
+	ctx := context.Background()
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+
+		_ = c.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	t, err := s.handshake(ctx, c)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var noDeadline time.Time
+	_ = c.SetDeadline(noDeadline)
+
+	relay(c, t)
+}
+
+func (s *SOCKSServer) handshake(ctx context.Context, c net.Conn) (net.Conn, error) {
+	b := make([]byte, 1+1+255)
+
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+
+	if b[0] != socks_Version5 {
+		return nil, errors.New("proxy/socks: unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+
+	methods := b[2 : 2+int(b[1])]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+
+	want := socks_AuthMethodNotRequired
+	if s.Authenticate != nil {
+		want = socks_AuthMethodUsernamePassword
+	}
+
+	am := socks_AuthMethodNoAcceptableMethods
+
+	for _, m := range methods {
+		if socks_AuthMethod(m) == want {
+			am = want
+			break
+		}
+	}
+
+	if _, err := c.Write([]byte{socks_Version5, byte(am)}); err != nil {
+		return nil, err
+	}
+
+	switch am {
+	case socks_AuthMethodNoAcceptableMethods:
+		return nil, errors.New("proxy/socks: no acceptable authentication methods")
+	case socks_AuthMethodUsernamePassword:
+		if err := s.authenticate(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(c, b[:3]); err != nil {
+		return nil, err
+	}
+
+	if b[0] != socks_Version5 {
+		return nil, errors.New("proxy/socks: unexpected protocol version " + strconv.Itoa(int(b[0])))
+	}
+
+	cmd := socks_Command(b[1])
+
+	addr, err := socksReadAddr(c)
+	if err != nil {
+		if errors.Is(err, errSOCKSAddrType) {
+			_ = socksWriteReply(c, socksReplyAddrTypeNotSupported, nil)
+		}
+
+		return nil, err
+	}
+
+	if cmd != socks_CmdConnect {
+		_ = socksWriteReply(c, socksReplyCommandNotSupported, nil)
+		return nil, fmt.Errorf("proxy/socks: command not supported: %v", cmd)
+	}
+
+	d := s.Dialer
+	if d == nil {
+		d = Direct
+	}
+
+	t, err := Dial(ctx, d, "tcp", addr.String())
+	if err != nil {
+		_ = socksWriteReply(c, socksReplyFromError(err), nil)
+		return nil, fmt.Errorf("proxy/socks: dial %v: %w", addr, err)
+	}
+
+	if err := socksWriteReply(c, socks_StatusSucceeded, t.LocalAddr()); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (s *SOCKSServer) authenticate(c net.Conn) error {
+	b := make([]byte, 255)
+
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return err
+	}
+
+	if b[0] != socks_authUsernamePasswordVersion {
+		return errors.New("proxy/socks: invalid username/password version")
+	}
+
+	ulen := int(b[1])
+	if _, err := io.ReadFull(c, b[:ulen]); err != nil {
+		return err
+	}
+
+	username := string(b[:ulen])
+
+	if _, err := io.ReadFull(c, b[:1]); err != nil {
+		return err
+	}
+
+	plen := int(b[0])
+	if _, err := io.ReadFull(c, b[:plen]); err != nil {
+		return err
+	}
+
+	password := string(b[:plen])
+
+	if !s.Authenticate(username, password) {
+		_, _ = c.Write([]byte{socks_authUsernamePasswordVersion, 0x01})
+		return errors.New("proxy/socks: username/password authentication failed")
+	}
+
+	_, err := c.Write([]byte{socks_authUsernamePasswordVersion, socks_authStatusSucceeded})
+
+	return err
+}
+
+var errSOCKSAddrType = errors.New("proxy/socks: unknown address type")
+
+// socksReadAddr reads an address in the format of ATYP, DST.ADDR and
+// DST.PORT fields.
+func socksReadAddr(r io.Reader) (*socks_Addr, error) {
+	b := make([]byte, 1+255+2)
+
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, err
+	}
+
+	var a socks_Addr
+
+	l := 2
+
+	switch b[0] {
+	case socks_AddrTypeIPv4:
+		l += net.IPv4len
+		a.IP = make(net.IP, net.IPv4len)
+	case socks_AddrTypeIPv6:
+		l += net.IPv6len
+		a.IP = make(net.IP, net.IPv6len)
+	case socks_AddrTypeFQDN:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return nil, err
+		}
+
+		l += int(b[0])
+	default:
+		return nil, errSOCKSAddrType
+	}
+
+	b = b[:l]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	if a.IP != nil {
+		copy(a.IP, b)
+	} else {
+		a.Name = string(b[:len(b)-2])
+	}
+
+	a.Port = int(b[len(b)-2])<<8 | int(b[len(b)-1])
+
+	return &a, nil
+}
+
+// socksAppendAddr appends addr to b in the format of ATYP, ADDR and PORT
+// fields. A nil addr, or one that is not a TCP, UDP or SOCKS address, is
+// written as 0.0.0.0:0.
+func socksAppendAddr(b []byte, addr net.Addr) []byte {
+	var a socks_Addr
+
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		a.IP, a.Port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		a.IP, a.Port = addr.IP, addr.Port
+	case *socks_Addr:
+		a = *addr
+	}
+
+	switch {
+	case a.IP == nil && a.Name != "" && len(a.Name) <= 255:
+		b = append(b, socks_AddrTypeFQDN, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	case a.IP.To4() != nil:
+		b = append(b, socks_AddrTypeIPv4)
+		b = append(b, a.IP.To4()...)
+	case a.IP.To16() != nil:
+		b = append(b, socks_AddrTypeIPv6)
+		b = append(b, a.IP.To16()...)
+	default:
+		b = append(b, socks_AddrTypeIPv4, 0, 0, 0, 0)
+	}
+
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+func socksWriteReply(w io.Writer, code socks_Reply, addr net.Addr) error {
+	b := make([]byte, 0, 3+1+255+2)
+	b = append(b, socks_Version5, byte(code), 0)
+	b = socksAppendAddr(b, addr)
+	_, err := w.Write(b)
+
+	return err
+}
+
+func socksReplyFromError(err error) socks_Reply {
+	var ne net.Error
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socksReplyHostUnreachable
+	case errors.As(err, &ne) && ne.Timeout():
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSOCKSServer(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+	s := &SOCKSServer{
+		Authenticate: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+		Timeout: 5 * time.Second,
+	}
+	server := serveTest(t, s.ServeConn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d, err := FromURL(&url.URL{Scheme: "socks5h", User: url.UserPassword("user", "pass"), Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(ctx, d, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello" {
+		t.Errorf("got %q, want %q", b, "hello")
+	}
+
+	d, err = FromURL(&url.URL{Scheme: "socks5h", User: url.UserPassword("user", "wrong"), Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := Dial(ctx, d, "tcp", echo); err == nil {
+		c.Close()
+		t.Error("dial succeeded with a wrong password")
+	}
+}
+
+func TestSOCKSServerRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := l.Addr().String()
+	l.Close()
+
+	server := serveTest(t, (&SOCKSServer{}).ServeConn)
+
+	d, err := FromURL(&url.URL{Scheme: "socks5h", Host: server}, Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if c, err := Dial(ctx, d, "tcp", closed); err == nil {
+		c.Close()
+		t.Fatal("dial succeeded")
+	} else if want := socksReplyConnectionRefused.String(); !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
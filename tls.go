@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+func init() {
+	proxy_RegisterDialerType("tls", tlsFromURL)
+}
+
+// tlsFromURL returns a tls Dialer, which runs a TLS client handshake over
+// connections made by forward, configured by tlsConfigFromURL. The host of
+// u is not dialed, but is the default server name if present. Otherwise,
+// the server name defaults to the host being dialed.
+func tlsFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
+	config, err := tlsConfigFromURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsDialer{config, forward}, nil
+}
+
+type tlsDialer struct {
+	Config  *tls.Config
+	Forward proxy_Dialer
+}
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *tlsDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy/tls: network not implemented: %v", network)
+	}
+
+	config := d.Config
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/tls: dial %v: %w", addr, err)
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	c, err = Dial(ctx, d.Forward, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy/tls: dial %v: %w", addr, err)
+	}
+
+	defer func() {
+		if c != nil {
+			var noDeadline time.Time
+			_ = c.SetDeadline(noDeadline)
+		}
+	}()
+
+	if d, ok := ctx.Deadline(); ok && !d.IsZero() {
+		_ = c.SetDeadline(d)
+	}
+
+	if ctx.Done() != nil {
+		watch := make(chan struct{})
+		done := make(chan struct{})
+
+		defer func() {
+			close(done)
+
+			if err == nil {
+				<-watch
+			}
+		}()
+
+		go func(c net.Conn) {
+			defer close(watch)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				aLongTimeAgo := time.Unix(1, 0)
+				_ = c.SetDeadline(aLongTimeAgo)
+			}
+		}(c)
+	}
+
+	tc := tls.Client(c, config)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+
+		return nil, fmt.Errorf("proxy/tls: handshake with %v: %w", addr, err)
+	}
+
+	return tc, nil
+}
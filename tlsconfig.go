@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// tlsQueryKeys are query parameters that tlsConfigFromURL recognizes.
+var tlsQueryKeys = []string{"sni", "alpn", "min", "max", "ca", "cert", "key", "pin", "insecure"}
+
+// tlsConfigFromURL returns a *tls.Config configured by query parameters of
+// u as follows:
+//
+//	sni       server name, defaults to the hostname of u
+//	alpn      application protocol, can be repeated or comma-separated
+//	min, max  minimum and maximum versions, like "1.2" or "1.3"
+//	ca        file of PEM encoded certificates to verify the server with
+//	cert, key files of PEM encoded certificate and key for client auth
+//	pin       base64 encoded SHA-256 hash of the SubjectPublicKeyInfo of
+//	          a certificate in the verified chain, or of the server's
+//	          certificate if insecure, can be repeated
+//	insecure  if true, skips verifying the server, but not pins
+func tlsConfigFromURL(u *url.URL) (*tls.Config, error) {
+	values := u.Query()
+
+	config := &tls.Config{ServerName: values.Get("sni")}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+
+	for _, s := range values["alpn"] {
+		for _, proto := range strings.Split(s, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				config.NextProtos = append(config.NextProtos, proto)
+			}
+		}
+	}
+
+	for key, p := range map[string]*uint16{"min": &config.MinVersion, "max": &config.MaxVersion} {
+		if s := values.Get(key); s != "" {
+			v, ok := tlsVersions[s]
+			if !ok {
+				return nil, fmt.Errorf("proxy/tls: %v: unknown version: %v", key, s)
+			}
+
+			*p = v
+		}
+	}
+
+	if s := values.Get("insecure"); s != "" {
+		insecure, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/tls: insecure: %w", err)
+		}
+
+		config.InsecureSkipVerify = insecure
+	}
+
+	if name := values.Get("ca"); name != "" {
+		pem, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/tls: ca: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("proxy/tls: ca: no certificates found in %v", name)
+		}
+	}
+
+	if certFile, keyFile := values.Get("cert"), values.Get("key"); certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxy/tls: cert: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if pins := values["pin"]; len(pins) > 0 {
+		hashes := make([][]byte, len(pins))
+
+		for i, pin := range pins {
+			// A "+" in a query string decodes as a space, unless escaped.
+			pin = strings.ReplaceAll(strings.TrimPrefix(pin, "sha256/"), " ", "+")
+
+			h, err := decodeBase64String(pin)
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("proxy/tls: invalid pin: %v", pin)
+			}
+
+			hashes[i] = h
+		}
+
+		insecure := config.InsecureSkipVerify
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return tlsVerifyPins(cs, hashes, insecure)
+		}
+	}
+
+	return config, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var errTLSPinMismatch = errors.New("proxy/tls: no certificate matches pins")
+
+// tlsVerifyPins checks that a certificate in the verified chains has a
+// SubjectPublicKeyInfo whose SHA-256 hash is one of hashes. If insecure,
+// there are no verified chains, and only the server's certificate counts,
+// since anyone can append a pinned certificate to what they present.
+func tlsVerifyPins(cs tls.ConnectionState, hashes [][]byte, insecure bool) error {
+	if insecure {
+		if len(cs.PeerCertificates) > 0 && tlsMatchPins(cs.PeerCertificates[0], hashes) {
+			return nil
+		}
+
+		return errTLSPinMismatch
+	}
+
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if tlsMatchPins(cert, hashes) {
+				return nil
+			}
+		}
+	}
+
+	return errTLSPinMismatch
+}
+
+// tlsMatchPins reports whether the SHA-256 hash of the SubjectPublicKeyInfo
+// of cert is one of hashes.
+func tlsMatchPins(cert *x509.Certificate, hashes [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	for _, h := range hashes {
+		if bytes.Equal(sum[:], h) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for name, signed by parent, or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert, key}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsHandshake makes a handshake between a client configured by query and
+// a server presenting chain, and returns the error that the client gets.
+func tlsHandshake(t *testing.T, query url.Values, chain ...*testCert) error {
+	t.Helper()
+
+	config, err := tlsConfigFromURL(&url.URL{Scheme: "tls", Host: "example.com:443", RawQuery: query.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{PrivateKey: chain[0].key}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.cert.Raw)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		s := tls.Server(c2, &tls.Config{Certificates: []tls.Certificate{cert}})
+		_ = s.Handshake()
+		s.Close()
+	}()
+
+	return tls.Client(c1, config).Handshake()
+}
+
+func TestTLSVerifyPins(t *testing.T) {
+	root := newTestCert(t, "root", true, nil)
+	leaf := newTestCert(t, "example.com", false, root)
+	other := newTestCert(t, "example.com", false, nil)
+	pinned := newTestCert(t, "pinned", true, nil)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		chain []*testCert
+		ok    bool
+	}{
+		{"insecure leaf", url.Values{"insecure": {"1"}, "pin": {other.pin()}}, []*testCert{other}, true},
+		{"insecure appended", url.Values{"insecure": {"1"}, "pin": {pinned.pin()}}, []*testCert{other, pinned}, false},
+		{"verified leaf", url.Values{"ca": {ca}, "pin": {leaf.pin()}}, []*testCert{leaf}, true},
+		{"verified root", url.Values{"ca": {ca}, "pin": {root.pin()}}, []*testCert{leaf}, true},
+		{"verified appended", url.Values{"ca": {ca}, "pin": {pinned.pin()}}, []*testCert{leaf, pinned}, false},
+	}
+
+	for _, tt := range tests {
+		err := tlsHandshake(t, tt.query, tt.chain...)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+		case !tt.ok && !errors.Is(err, errTLSPinMismatch):
+			t.Errorf("%v: got %v, want %v", tt.name, err, errTLSPinMismatch)
+		}
+	}
+}
+
+func TestTLSConfigPinPlus(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xfb, 0xef, 0xbe}, 11)[:sha256.Size])
+	if !strings.Contains(pin, "+") {
+		t.Fatalf("pin %v has no +", pin)
+	}
+
+	// Not escaped, "+" becomes a space in the query.
+	if _, err := tlsConfigFromURL(&url.URL{Scheme: "tls", Host: "example.com:443", RawQuery: "pin=" + pin}); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,10 +2,17 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,12 +23,134 @@ func init() {
 	proxy_RegisterDialerType("wss", wsFromURL)
 }
 
+// wsFromURL returns a ws or wss Dialer configured by u. Besides TLS options
+// recognized by tlsConfigFromURL, the following query parameters are
+// recognized, and removed from the URL to dial:
+//
+//	host      Host header, defaults to the host of u
+//	header    extra header in the form of "Name: value", can be repeated
+//	protocol  subprotocol to request, can be repeated
+//	timeout   handshake timeout, like "10s", defaults to 45s
+//	ping      interval of pings, like "30s", no pings by default
+//	pongtimeout
+//	          time to wait for a pong, defaults to the ping interval
+//	ed        maximum bytes of early data, see below
+//	edheader  header that carries early data, defaults to
+//	          Sec-WebSocket-Protocol
+//	edpath    if true, carries early data in a path segment prefixed
+//	          with "ed=", appended to the path, instead of a header
+//
+// With early data, DialContext returns before connecting, and the first
+// Write connects, sending up to ed bytes, encoded in unpadded base64url,
+// along with the handshake request. A WebSocketHandler accepts them if
+// configured with the same header or path option.
 func wsFromURL(u *url.URL, forward proxy_Dialer) (proxy_Dialer, error) {
-	return &wsDialer{u, forward}, nil
+	values := u.Query()
+
+	d := &wsDialer{
+		Subprotocols:     values["protocol"],
+		HandshakeTimeout: 45 * time.Second,
+		Forward:          forward,
+	}
+
+	var err error
+
+	if u.Scheme == "wss" {
+		if d.TLSConfig, err = tlsConfigFromURL(u); err != nil {
+			return nil, fmt.Errorf("proxy/websocket: %w", err)
+		}
+
+		if values.Get("sni") == "" {
+			// Let websocket.Dialer take the server name from the URL
+			// to dial, whose host may be filled in by DialContext.
+			d.TLSConfig.ServerName = ""
+		}
+	}
+
+	if d.Header, err = httpParseHeader(values["header"]); err != nil {
+		return nil, fmt.Errorf("proxy/websocket: %w", err)
+	}
+
+	if host := values.Get("host"); host != "" {
+		d.Header.Set("Host", host)
+	}
+
+	if s := values.Get("timeout"); s != "" {
+		if d.HandshakeTimeout, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("proxy/websocket: timeout: %w", err)
+		}
+	}
+
+	if s := values.Get("ping"); s != "" {
+		if d.PingInterval, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("proxy/websocket: ping: %w", err)
+		}
+	}
+
+	if s := values.Get("pongtimeout"); s != "" {
+		if d.PongTimeout, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("proxy/websocket: pongtimeout: %w", err)
+		}
+	}
+
+	if s := values.Get("ed"); s != "" {
+		if d.EarlyData, err = strconv.Atoi(s); err != nil || d.EarlyData < 0 {
+			return nil, fmt.Errorf("proxy/websocket: invalid ed: %v", s)
+		}
+	}
+
+	if s := values.Get("edpath"); s != "" {
+		if d.EarlyDataPath, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("proxy/websocket: edpath: %w", err)
+		}
+	}
+
+	if d.EarlyData > 0 && !d.EarlyDataPath {
+		d.EarlyDataHeader = values.Get("edheader")
+		if d.EarlyDataHeader == "" {
+			d.EarlyDataHeader = wsEarlyDataHeader
+		}
+
+		d.EarlyDataHeader = http.CanonicalHeaderKey(d.EarlyDataHeader)
+
+		if d.EarlyDataHeader == http.CanonicalHeaderKey(wsEarlyDataHeader) && len(d.Subprotocols) > 0 {
+			return nil, errors.New("proxy/websocket: ed conflicts with protocol")
+		}
+	}
+
+	keys := []string{
+		"host", "header", "protocol", "timeout", "ping", "pongtimeout",
+		"ed", "edheader", "edpath",
+	}
+
+	for _, key := range append(keys, tlsQueryKeys...) {
+		values.Del(key)
+	}
+
+	snapshot := *u
+	snapshot.RawQuery = values.Encode()
+	d.URL = &snapshot
+
+	return d, nil
 }
 
 type wsDialer struct {
-	URL     *url.URL
+	URL              *url.URL
+	Header           http.Header // extra headers sent with handshake requests
+	Subprotocols     []string
+	TLSConfig        *tls.Config // used by wss URLs
+	HandshakeTimeout time.Duration
+	PingInterval     time.Duration // if positive, sends pings
+	PongTimeout      time.Duration
+
+	// EarlyData specifies the maximum bytes of the first Write to send
+	// with handshake requests, in EarlyDataHeader, or in a path segment
+	// prefixed with wsEarlyDataPrefix, appended to the path, if
+	// EarlyDataPath is true. Zero disables early data.
+	EarlyData       int
+	EarlyDataHeader string
+	EarlyDataPath   bool
+
 	Forward proxy_Dialer
 }
 
@@ -36,15 +165,57 @@ func (d *wsDialer) DialContext(ctx context.Context, network, addr string) (net.C
 		return nil, fmt.Errorf("proxy/websocket: network not implemented: %v", network)
 	}
 
+	if d.EarlyData > 0 {
+		return newWSEarlyConn(d, addr), nil
+	}
+
+	c, err := d.dial(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// dial connects to addr through Forward, and makes a WebSocket handshake
+// with early data in it, if any.
+func (d *wsDialer) dial(ctx context.Context, addr string, early []byte) (*wsConnection, error) {
+	// websocket.Dialer honors the deadline of ctx, but not cancellation,
+	// after connecting. Watch ctx as other handshakes do.
+	var (
+		netConn net.Conn
+		watch   = make(chan struct{})
+		done    = make(chan struct{})
+	)
+
 	dialer := &websocket.Dialer{
-		NetDialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
-			return Dial(ctx, d.Forward, network, addr) // Use addr from dialTCP.
+		NetDialContext: func(dialCtx context.Context, network, _ string) (net.Conn, error) {
+			c, err := Dial(dialCtx, d.Forward, network, addr) // Use addr from dialTCP.
+			if err != nil || ctx.Done() == nil {
+				return c, err
+			}
+
+			netConn = c
+
+			go func() {
+				defer close(watch)
+				select {
+				case <-done:
+				case <-ctx.Done():
+					aLongTimeAgo := time.Unix(1, 0)
+					_ = c.SetDeadline(aLongTimeAgo)
+				}
+			}()
+
+			return c, nil
 		},
-		HandshakeTimeout: 45 * time.Second,
+		HandshakeTimeout: d.HandshakeTimeout,
+		Subprotocols:     d.Subprotocols,
+		TLSClientConfig:  d.TLSConfig,
 	}
 
 	u := d.URL
-	if u.Host == "" || u.Path == "" {
+	if u.Host == "" || u.Path == "" || len(early) > 0 {
 		snapshot := *d.URL
 		u = &snapshot
 
@@ -57,7 +228,40 @@ func (d *wsDialer) DialContext(ctx context.Context, network, addr string) (net.C
 		}
 	}
 
-	conn, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	header := d.Header
+
+	if len(early) > 0 {
+		s := base64.RawURLEncoding.EncodeToString(early)
+
+		if d.EarlyDataPath {
+			if !strings.HasSuffix(u.Path, "/") {
+				u.Path += "/"
+			}
+
+			u.Path += wsEarlyDataPrefix + s
+			u.RawPath = ""
+		} else {
+			header = header.Clone()
+			if header == nil {
+				header = make(http.Header)
+			}
+
+			header.Set(d.EarlyDataHeader, s)
+		}
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+
+	if netConn != nil {
+		close(done)
+		<-watch
+
+		if err == nil {
+			var noDeadline time.Time
+			_ = netConn.SetDeadline(noDeadline)
+		}
+	}
+
 	if err != nil {
 		if resp != nil {
 			return nil, fmt.Errorf("proxy/websocket: dial %v: %w (%v)", u.String(), err, resp.Status)
@@ -66,24 +270,178 @@ func (d *wsDialer) DialContext(ctx context.Context, network, addr string) (net.C
 		return nil, fmt.Errorf("proxy/websocket: dial %v: %w", u.String(), err)
 	}
 
-	return &wsConnection{ws: conn}, nil
+	return newWSConnection(conn, d.PingInterval, d.PongTimeout), nil
 }
 
+// Timeouts of wsConnection.
+const (
+	wsWriteWait    = 10 * time.Second // for writing control frames
+	wsCloseTimeout = 1 * time.Second  // for waiting for the peer to close
+)
+
+var errWSPongTimeout = errors.New("pong timeout")
+
+// wsConnection is a net.Conn that sends and receives bytes as binary
+// messages over a WebSocket connection.
+//
+// Close frames are half-closes: CloseWrite sends one, and Read returns
+// io.EOF after receiving a normal one, while the other direction stays
+// open. Close sends a close frame if not yet, and waits for the peer's
+// one for a short while before closing the underlying connection.
 type wsConnection struct {
 	ws     *websocket.Conn
 	reader io.Reader
+	rerr   error // returned by every Read once reading fails
+
+	pong      chan struct{}
+	readDone  chan struct{} // closed once reading fails, e.g. on a close frame
+	readOnce  sync.Once
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+	closeErr  error
+
+	mu      sync.Mutex
+	readers int
+	closing bool
+	err     error // why the connection failed, e.g. a pong timeout
 }
 
-func (c *wsConnection) Read(b []byte) (n int, err error) {
+// newWSConnection returns a wsConnection over ws. If pingInterval is
+// positive, it sends a ping every pingInterval, and fails the connection
+// if no pong is received in pongTimeout, which defaults to pingInterval.
+// Since pongs are received only when reading, a missing pong fails the
+// connection only if a Read is in progress, which a relay always has.
+func newWSConnection(ws *websocket.Conn, pingInterval, pongTimeout time.Duration) *wsConnection {
+	c := &wsConnection{
+		ws:       ws,
+		readDone: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// Do not echo close frames, so that the peer can half-close, and this
+	// side keeps writing until CloseWrite.
+	ws.SetCloseHandler(func(int, string) error { return nil })
+
+	if pingInterval > 0 {
+		if pongTimeout <= 0 {
+			pongTimeout = pingInterval
+		}
+
+		c.pong = make(chan struct{}, 1)
+
+		ws.SetPongHandler(func(string) error {
+			select {
+			case c.pong <- struct{}{}:
+			default:
+			}
+
+			return nil
+		})
+
+		go c.keepAlive(pingInterval, pongTimeout)
+	}
+
+	return c
+}
+
+func (c *wsConnection) keepAlive(pingInterval, pongTimeout time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		select { // Discard a late pong.
+		case <-c.pong:
+		default:
+		}
+
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+			return
+		}
+
+		timer := time.NewTimer(pongTimeout)
+
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-c.pong:
+			timer.Stop()
+		case <-timer.C:
+			if c.reading() {
+				c.fail(errWSPongTimeout)
+				return
+			}
+		}
+	}
+}
+
+// reading reports whether a Read is in progress, which receives pongs.
+func (c *wsConnection) reading() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readers > 0
+}
+
+// fail closes the underlying connection, so that pending and later reads
+// and writes return err.
+func (c *wsConnection) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	c.ws.Close()
+}
+
+func (c *wsConnection) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *wsConnection) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("proxy/websocket: read: %w", net.ErrClosed)
+	}
+	c.readers++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.readers--
+		c.mu.Unlock()
+	}()
+
+	// Reading fails for good once it fails. The websocket package panics
+	// if NextReader is called again too many times after that.
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+
 	for {
 		if c.reader == nil {
 			_, reader, err := c.ws.NextReader()
 			if err != nil {
-				if err != io.EOF { // Should not wrap io.EOF.
-					err = fmt.Errorf("proxy/websocket: read: %w", err)
+				c.readOnce.Do(func() { close(c.readDone) })
+
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+					c.rerr = io.EOF
+				} else {
+					c.rerr = c.error("read", err)
 				}
 
-				return 0, err
+				return 0, c.rerr
 			}
 
 			c.reader = reader
@@ -92,25 +450,103 @@ func (c *wsConnection) Read(b []byte) (n int, err error) {
 		n, err := c.reader.Read(b)
 		if err == io.EOF {
 			c.reader = nil
-			continue
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		if err != nil {
+			err = c.error("read", err)
+			c.rerr = err
 		}
 
-		return n, fmt.Errorf("proxy/websocket: read: %w", err)
+		return n, err
 	}
 }
 
 func (c *wsConnection) Write(b []byte) (n int, err error) {
 	err = c.ws.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
-		err = fmt.Errorf("proxy/websocket: write: %w", err)
-		return
+		return 0, c.error("write", err)
 	}
 
 	return len(b), nil
 }
 
+// error returns err, or why the connection failed if it did, wrapped
+// with op.
+func (c *wsConnection) error(op string, err error) error {
+	if e := c.failure(); e != nil {
+		err = e
+	}
+
+	return fmt.Errorf("proxy/websocket: %v: %w", op, err)
+}
+
+// CloseWrite sends a close frame, after which the peer reads io.EOF.
+func (c *wsConnection) CloseWrite() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+
+	err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	if err != nil && err != websocket.ErrCloseSent {
+		return c.error("close write", err)
+	}
+
+	return nil
+}
+
 func (c *wsConnection) Close() error {
-	return c.ws.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		if c.CloseWrite() == nil {
+			c.waitClose()
+		}
+
+		if err := c.ws.Close(); err != nil && c.failure() == nil {
+			c.closeErr = fmt.Errorf("proxy/websocket: close: %w", err)
+		}
+	})
+
+	return c.closeErr
+}
+
+// waitClose waits for the peer's close frame, for at most wsCloseTimeout.
+// If no Read is in progress, it reads and discards messages by itself.
+func (c *wsConnection) waitClose() {
+	c.mu.Lock()
+	c.closing = true
+	readers := c.readers
+	c.mu.Unlock()
+
+	if readers > 0 {
+		timer := time.NewTimer(wsCloseTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-c.readDone:
+		case <-timer.C:
+		}
+
+		return
+	}
+
+	select {
+	case <-c.readDone:
+		return
+	default:
+	}
+
+	_ = c.ws.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+
+	for {
+		if _, _, err := c.ws.NextReader(); err != nil {
+			return
+		}
+	}
 }
 
 func (c *wsConnection) LocalAddr() net.Addr {
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testWSConnection returns a wsConnection to a server that serves each
+// WebSocket connection with serve.
+func testWSConnection(t *testing.T, pingInterval, pongTimeout time.Duration, serve func(ws *websocket.Conn)) *wsConnection {
+	t.Helper()
+
+	upgrader := &websocket.Upgrader{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		serve(ws)
+	}))
+	t.Cleanup(s.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newWSConnection(ws, pingInterval, pongTimeout)
+	t.Cleanup(func() { c.Close() })
+
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return c
+}
+
+func TestWSConnectionRead(t *testing.T) {
+	c := testWSConnection(t, 0, 0, func(ws *websocket.Conn) {
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte("world"))
+		_ = ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		_, _, _ = ws.NextReader()
+	})
+
+	b := make([]byte, 64)
+
+	for _, want := range []string{"hello", "world"} {
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if string(b[:n]) != want {
+			t.Errorf("got %q, want %q", b[:n], want)
+		}
+	}
+
+	if n, err := c.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("got %v, %v after a normal close frame, want 0, io.EOF", n, err)
+	}
+}
+
+func TestWSConnectionReadAfterFailure(t *testing.T) {
+	for _, closeFrame := range []bool{true, false} {
+		c := testWSConnection(t, 0, 0, func(ws *websocket.Conn) {
+			if closeFrame {
+				_ = ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			}
+		})
+
+		b := make([]byte, 64)
+
+		_, want := c.Read(b)
+		if want == nil {
+			t.Fatal("got no error")
+		}
+
+		// The websocket package panics after 1000 reads on a failed
+		// connection.
+		for i := 0; i < 2000; i++ {
+			if _, err := c.Read(b); err != want {
+				t.Fatalf("read #%v: got %v, want %v", i, err, want)
+			}
+		}
+	}
+}
+
+func TestWSConnectionCloseWrite(t *testing.T) {
+	received := make(chan string, 1)
+
+	c := testWSConnection(t, 0, 0, func(ws *websocket.Conn) {
+		s := newWSConnection(ws, 0, 0)
+		defer s.Close()
+
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+
+		received <- string(b)
+
+		_, _ = s.Write([]byte("bye"))
+	})
+
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := <-received; s != "hi" {
+		t.Errorf("server got %q, want %q", s, "hi")
+	}
+
+	// The other direction is still open.
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "bye" {
+		t.Errorf("got %q, want %q", b, "bye")
+	}
+}
+
+func TestWSConnectionPongTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	// Not reading, the server never answers pings.
+	c := testWSConnection(t, 50*time.Millisecond, 50*time.Millisecond, func(*websocket.Conn) { <-done })
+
+	if _, err := c.Read(make([]byte, 64)); !errors.Is(err, errWSPongTimeout) {
+		t.Errorf("got %v, want %v", err, errWSPongTimeout)
+	}
+}
+
+func TestWebSocketBanner(t *testing.T) {
+	server := serveTest(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		h := sha1.New()
+		h.Write([]byte(req.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+		frame := append([]byte{0x82, byte(len(testBanner))}, testBanner...) // Binary, unmasked.
+
+		_, _ = c.Write(append([]byte("HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Sec-WebSocket-Accept: "+accept+"\r\n\r\n"), frame...))
+		_, _ = io.Copy(ioutil.Discard, br)
+	})
+
+	d, err := FromURL(&url.URL{Scheme: "ws", Host: "example.com", Path: "/"}, testRedirect(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialBanner(t, d)
+}
+
+func TestWSEarlyConnDeadlineAndClose(t *testing.T) {
+	// A server that never answers handshakes.
+	server := serveTest(t, func(c net.Conn) { _, _ = io.Copy(ioutil.Discard, c) })
+
+	d, err := FromURL(&url.URL{Scheme: "ws", Host: "example.com", Path: "/", RawQuery: "ed=16"}, testRedirect(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.Dial("tcp", "192.0.2.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read honors the read deadline before connecting.
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if _, err := c.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	written := make(chan error, 1)
+
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		written <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Close cancels the handshake in progress.
+	closed := make(chan error, 1)
+
+	go func() { closed <- c.Close() }()
+
+	for _, ch := range []chan error{closed, written} {
+		select {
+		case err := <-ch:
+			if ch == written && err == nil {
+				t.Error("Write succeeded after Close")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close did not cancel the handshake")
+		}
+	}
+}
+
+func TestWebSocketHandlerEarlyDataPath(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+	s := httptest.NewServer(&WebSocketHandler{Target: echo, EarlyDataPath: true})
+	t.Cleanup(s.Close)
+
+	for _, query := range []string{"", "ed=64&edpath=1"} {
+		u := &url.URL{Scheme: "ws", Host: "example.com", Path: "/ws", RawQuery: query}
+
+		d, err := FromURL(u, testRedirect(strings.TrimPrefix(s.URL, "http://")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := d.Dial("tcp", "192.0.2.1:22")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "hello" {
+			t.Errorf("%q: got %q, want %q", query, b, "hello")
+		}
+
+		c.Close()
+	}
+}
+
+func TestWebSocketHandlerEarlyDataHeader(t *testing.T) {
+	echo := serveTest(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+	for _, header := range []string{"", "X-Early-Data"} {
+		name := header
+		if name == "" {
+			name = wsEarlyDataHeader
+		}
+
+		got := make(chan string, 1)
+		h := &WebSocketHandler{Target: echo, EarlyDataHeader: name}
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got <- r.Header.Get(name)
+			h.ServeHTTP(w, r)
+		}))
+		t.Cleanup(s.Close)
+
+		query := url.Values{"ed": {"5"}}
+		if header != "" {
+			query.Set("edheader", header)
+		}
+
+		u := &url.URL{Scheme: "ws", Host: "example.com", Path: "/ws", RawQuery: query.Encode()}
+
+		d, err := FromURL(u, testRedirect(strings.TrimPrefix(s.URL, "http://")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := d.Dial("tcp", "192.0.2.1:22")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Only the first 5 bytes are sent as early data.
+		const msg = "hello world"
+
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != msg {
+			t.Errorf("%v: got %q, want %q", name, b, msg)
+		}
+
+		if v, want := <-got, base64.RawURLEncoding.EncodeToString([]byte("hello")); v != want {
+			t.Errorf("%v: got %q in header, want %q", name, v, want)
+		}
+
+		c.Close()
+	}
+}
+
+// testDialCounter is a Dialer that counts dials.
+type testDialCounter struct {
+	n int32
+}
+
+func (d *testDialCounter) Dial(network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.n, 1)
+	return net.Dial(network, addr)
+}
+
+func TestWebSocketHandlerNotUpgrade(t *testing.T) {
+	var d testDialCounter
+
+	s := httptest.NewServer(&WebSocketHandler{Dialer: &d})
+	t.Cleanup(s.Close)
+
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %v, want %v", resp.Status, http.StatusBadRequest)
+	}
+
+	if n := atomic.LoadInt32(&d.n); n != 0 {
+		t.Errorf("dialed %v times, want 0", n)
+	}
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// wsEarlyDataHeader is the default header that carries early data, which
+// v2ray-style servers also accept.
+const wsEarlyDataHeader = "Sec-WebSocket-Protocol"
+
+// wsEarlyDataPrefix marks the path segment that carries early data, which
+// is appended to the request path. Without it, the last segment of a path
+// like "/ws" would be mistaken for early data.
+const wsEarlyDataPrefix = "ed="
+
+// wsEarlyConn is a net.Conn that connects on the first Write, sending up
+// to EarlyData bytes of it with the handshake request. Read waits until
+// then, or until the read deadline. Deadlines set before connecting apply
+// once connected.
+type wsEarlyConn struct {
+	d    *wsDialer
+	addr string
+
+	ready   chan struct{} // closed once connected, failed, or closed
+	rnotify chan struct{} // notified when the read deadline changes
+	wnotify chan struct{} // notified when the write deadline changes
+
+	mu            sync.Mutex
+	started       bool
+	cancel        context.CancelFunc // cancels the dial in progress
+	closed        bool
+	conn          *wsConnection
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newWSEarlyConn(d *wsDialer, addr string) *wsEarlyConn {
+	return &wsEarlyConn{
+		d:       d,
+		addr:    addr,
+		ready:   make(chan struct{}),
+		rnotify: make(chan struct{}, 1),
+		wnotify: make(chan struct{}, 1),
+	}
+}
+
+// start reports whether the caller is the first one to connect, in which
+// case the caller must call connect with the returned context.
+func (c *wsEarlyConn) start() (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started {
+		return nil, false
+	}
+
+	c.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	return ctx, true
+}
+
+// connect connects with early data. The dial is not bound to any context
+// but ctx, which Close cancels, and HandshakeTimeout.
+func (c *wsEarlyConn) connect(ctx context.Context, early []byte) {
+	conn, err := c.d.dial(ctx, c.addr, early)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cancel()
+	c.cancel = nil
+
+	switch {
+	case c.closed:
+		if conn != nil {
+			conn.ws.Close()
+		}
+
+		c.err = fmt.Errorf("proxy/websocket: %w", net.ErrClosed)
+	case err != nil:
+		c.err = err
+	default:
+		_ = conn.SetReadDeadline(c.readDeadline)
+		_ = conn.SetWriteDeadline(c.writeDeadline)
+
+		c.conn = conn
+	}
+
+	close(c.ready)
+}
+
+// wait waits for connect, and returns its result, or an error if the
+// deadline returned by deadline passes first. notify is notified when the
+// deadline changes.
+func (c *wsEarlyConn) wait(op string, notify chan struct{}, deadline func() time.Time) (*wsConnection, error) {
+	for {
+		select {
+		case <-c.ready:
+			return c.conn, c.err
+		default:
+		}
+
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+
+		if t := deadline(); !t.IsZero() {
+			d := time.Until(t)
+			if d <= 0 {
+				return nil, fmt.Errorf("proxy/websocket: %v: %w", op, os.ErrDeadlineExceeded)
+			}
+
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.ready:
+		case <-timeout:
+		case <-notify:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func wsNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsEarlyConn) Read(b []byte) (int, error) {
+	conn, err := c.wait("read", c.rnotify, func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return c.readDeadline
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.Read(b)
+}
+
+func (c *wsEarlyConn) waitWrite() (*wsConnection, error) {
+	return c.wait("write", c.wnotify, func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return c.writeDeadline
+	})
+}
+
+func (c *wsEarlyConn) Write(b []byte) (int, error) {
+	n := -1 // bytes sent as early data
+
+	if ctx, ok := c.start(); ok {
+		n = len(b)
+		if n > c.d.EarlyData {
+			n = c.d.EarlyData
+		}
+
+		c.connect(ctx, b[:n])
+	}
+
+	conn, err := c.waitWrite()
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return conn.Write(b)
+	}
+
+	if n == len(b) {
+		return n, nil
+	}
+
+	m, err := conn.Write(b[n:])
+
+	return n + m, err
+}
+
+// CloseWrite connects without early data if not yet, and sends a close
+// frame.
+func (c *wsEarlyConn) CloseWrite() error {
+	if ctx, ok := c.start(); ok {
+		c.connect(ctx, nil)
+	}
+
+	conn, err := c.waitWrite()
+	if err != nil {
+		return err
+	}
+
+	return conn.CloseWrite()
+}
+
+// Close closes the connection if connected. Otherwise, it cancels the dial
+// in progress, if any, without waiting for it.
+func (c *wsEarlyConn) Close() error {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.closed = true
+
+	conn := c.conn
+
+	switch {
+	case !c.started:
+		c.started = true
+		c.err = fmt.Errorf("proxy/websocket: %w", net.ErrClosed)
+		close(c.ready)
+	case c.cancel != nil:
+		c.cancel()
+	}
+
+	c.mu.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+
+	return nil
+}
+
+// LocalAddr returns the local address if connected, or a zero
+// *net.TCPAddr otherwise.
+func (c *wsEarlyConn) LocalAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.LocalAddr()
+	}
+
+	return &net.TCPAddr{}
+}
+
+// RemoteAddr returns the remote address if connected, or a zero
+// *net.TCPAddr otherwise.
+func (c *wsEarlyConn) RemoteAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.RemoteAddr()
+	}
+
+	return &net.TCPAddr{}
+}
+
+// current returns the connection if connected, or nil otherwise.
+func (c *wsEarlyConn) current() *wsConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+func (c *wsEarlyConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	err2 := c.SetWriteDeadline(t)
+
+	if err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+func (c *wsEarlyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	wsNotify(c.rnotify)
+
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+
+	return nil
+}
+
+func (c *wsEarlyConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	wsNotify(c.wnotify)
+
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+
+	return nil
+}
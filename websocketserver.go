@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A WebSocketHandler accepts WebSocket connections made by ws or wss
+// Dialers, and relays each of them to a target connected by a Dialer.
+type WebSocketHandler struct {
+	// Dialer specifies the Dialer used to connect to targets.
+	// If nil, Direct is used.
+	Dialer Dialer
+
+	// Target specifies a fixed target address. If empty, the target is
+	// taken from the Host of each request, which is where a ws Dialer
+	// puts the address it dials, when its URL has no host.
+	Target string
+
+	// CheckOrigin specifies an optional function to check the Origin
+	// header of each request. If nil, all origins are accepted.
+	CheckOrigin func(r *http.Request) bool
+
+	// PingInterval specifies how often to send pings. If zero, no pings
+	// are sent. A connection fails if no pong is received in
+	// PongTimeout, which defaults to PingInterval.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// EarlyDataHeader specifies the header that carries early data sent
+	// by ws Dialers with the ed query parameter, usually
+	// "Sec-WebSocket-Protocol", which is then echoed back. Early data is
+	// written to the target before relaying. If empty, no header is
+	// checked.
+	EarlyDataHeader string
+
+	// EarlyDataPath, if true, accepts early data in the last segment of
+	// the request path prefixed with "ed=", sent by ws Dialers with the
+	// edpath query parameter. A path without one has no early data.
+	EarlyDataPath bool
+}
+
+// ServeHTTP implements http.Handler.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Reject other requests before dialing anything.
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	target := handlerTarget(r, h.Target)
+
+	early, err := h.earlyData(r)
+	if err != nil {
+		http.Error(w, "invalid early data", http.StatusBadRequest)
+		return
+	}
+
+	var header http.Header
+
+	if h.EarlyDataHeader != "" && len(early) > 0 &&
+		http.CanonicalHeaderKey(h.EarlyDataHeader) == http.CanonicalHeaderKey(wsEarlyDataHeader) {
+		header = http.Header{wsEarlyDataHeader: {r.Header.Get(wsEarlyDataHeader)}}
+	}
+
+	d := h.Dialer
+	if d == nil {
+		d = Direct
+	}
+
+	t, err := Dial(r.Context(), d, "tcp", target)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = func(*http.Request) bool { return true }
+	}
+
+	upgrader := &websocket.Upgrader{CheckOrigin: checkOrigin}
+
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		t.Close()
+		return
+	}
+
+	if len(early) > 0 {
+		if _, err := t.Write(early); err != nil {
+			conn.Close()
+			t.Close()
+
+			return
+		}
+	}
+
+	relay(newWSConnection(conn, h.PingInterval, h.PongTimeout), t)
+}
+
+// earlyData returns early data in r, if any.
+func (h *WebSocketHandler) earlyData(r *http.Request) ([]byte, error) {
+	var s string
+
+	switch {
+	case h.EarlyDataPath:
+		s = r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		if !strings.HasPrefix(s, wsEarlyDataPrefix) {
+			return nil, nil
+		}
+
+		s = s[len(wsEarlyDataPrefix):]
+	case h.EarlyDataHeader != "":
+		s = r.Header.Get(h.EarlyDataHeader)
+	}
+
+	if s == "" {
+		return nil, nil
+	}
+
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// handlerTarget returns target if not empty, or the Host of r otherwise,
+// with the default port of the scheme if it has no port.
+func handlerTarget(r *http.Request, target string) string {
+	if target != "" {
+		return target
+	}
+
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+
+	port := "80"
+	if r.TLS != nil {
+		port = "443"
+	}
+
+	return net.JoinHostPort(r.Host, port)
+}